@@ -1,33 +1,232 @@
 package advertise
 
-import "context"
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrAdvertiseNotFound is returned when the requested advertise does not exist.
+	ErrAdvertiseNotFound = errors.New("advertise not found")
+	// ErrInvalidSchedule is returned when end_at is not after start_at.
+	ErrInvalidSchedule = errors.New("end_at must be after start_at")
+	// ErrInvalidState is returned when the admin listing is filtered by a state it does not know.
+	ErrInvalidState = errors.New("invalid state, use one of scheduled, live, expired")
+	// ErrInvalidPlacement is returned for a placement that is not one of the known slots.
+	ErrInvalidPlacement = errors.New("invalid placement, use one of home_hero, sidebar, category")
+)
+
+// MaxReorderIds is the most advertises a single reorder request may contain.
+const MaxReorderIds = 500
+
+// Placements are the slots of the storefront that show advertises.
+// Advertises saved before placements existed have none and are shown in the homepage hero.
+const (
+	PlacementHomeHero = "home_hero"
+	PlacementSidebar  = "sidebar"
+	PlacementCategory = "category"
+)
+
+// Placements lists every known placement.
+var Placements = []string{PlacementHomeHero, PlacementSidebar, PlacementCategory}
+
+// Schedule states of an advertise. They only look at the display window; IsEnabled is separate.
+const (
+	StateScheduled = "scheduled"
+	StateLive      = "live"
+	StateExpired   = "expired"
+)
 
 // Advertise defines the structure for an advertise.
+// Image is shown on desktop and MobileImage on small screens, falling back to Image when empty.
+// CategoryIDs limits a category placement to these category pages; empty means every category page.
 type Advertise struct {
-	ID        string `json:"id" firestore:"id"`
-	Name      string `json:"name" firestore:"name"`
-	Image     string `json:"image" firestore:"image"`
-	Link      string `json:"link,omitempty" firestore:"link,omitempty"`
-	IsEnabled bool   `json:"is_enabled" firestore:"is_enabled"`
+	ID          string     `json:"id" firestore:"id"`
+	Name        string     `json:"name" firestore:"name"`
+	Image       string     `json:"image" firestore:"image"`
+	MobileImage string     `json:"mobile_image" firestore:"mobile_image"`
+	Target      *Target    `json:"target" firestore:"target"`
+	IsEnabled   bool       `json:"is_enabled" firestore:"is_enabled"`
+	Placement   string     `json:"placement" firestore:"placement"`
+	Priority    int        `json:"priority" firestore:"priority"`
+	CategoryIDs []string   `json:"category_ids,omitempty" firestore:"category_ids,omitempty"`
+	StartAt     *time.Time `json:"start_at" firestore:"start_at"`
+	EndAt       *time.Time `json:"end_at" firestore:"end_at"`
+	State       string     `json:"state,omitempty" firestore:"-"`
+	CreatedAt   time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" firestore:"updated_at"`
+	CreatedBy   string     `json:"created_by" firestore:"created_by"`
+	UpdatedBy   string     `json:"updated_by" firestore:"updated_by"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" firestore:"deleted_at"`
+	DeletedBy   string     `json:"deleted_by,omitempty" firestore:"deleted_by,omitempty"`
+	Version     string     `json:"version,omitempty" firestore:"-"`
 }
 
 // ClientAdvertise is for client API responses (without IsEnabled field)
+// Path is the storefront path of the target, or its URL when IsExternal is set.
 type ClientAdvertise struct {
-	ID    string `json:"id" firestore:"id"`
-	Name  string `json:"name" firestore:"name"`
-	Image string `json:"image" firestore:"image"`
-	Link  string `json:"link,omitempty" firestore:"link,omitempty"`
+	ID          string     `json:"id" firestore:"id"`
+	Name        string     `json:"name" firestore:"name"`
+	Image       string     `json:"image" firestore:"image"`
+	MobileImage string     `json:"mobile_image" firestore:"mobile_image"`
+	Target      *Target    `json:"-" firestore:"target"`
+	Path        string     `json:"path,omitempty" firestore:"-"`
+	IsExternal  bool       `json:"is_external" firestore:"-"`
+	Placement   string     `json:"placement" firestore:"placement"`
+	Priority    int        `json:"priority" firestore:"priority"`
+	CategoryIDs []string   `json:"category_ids,omitempty" firestore:"category_ids,omitempty"`
+	StartAt     *time.Time `json:"start_at,omitempty" firestore:"start_at"`
+	EndAt       *time.Time `json:"end_at,omitempty" firestore:"end_at"`
+}
+
+// validateAdvertise fills in the default placement and checks the fields that need no lookups.
+func validateAdvertise(advertise *Advertise) error {
+	if err := normalizePlacement(advertise); err != nil {
+		return err
+	}
+	if !validSchedule(advertise.StartAt, advertise.EndAt) {
+		return ErrInvalidSchedule
+	}
+	if advertise.Target != nil {
+		return advertise.Target.validate()
+	}
+	return nil
+}
+
+// normalizePlacement fills in the default placement and rejects unknown ones.
+func normalizePlacement(advertise *Advertise) error {
+	if advertise.Placement == "" {
+		advertise.Placement = PlacementHomeHero
+	}
+	if !slices.Contains(Placements, advertise.Placement) {
+		return ErrInvalidPlacement
+	}
+	return nil
+}
+
+// showsOn reports whether the advertise belongs to placement and, for category pages,
+// to the page of categoryID. An empty categoryID matches every category advertise.
+func (a ClientAdvertise) showsOn(placement, categoryID string) bool {
+	current := a.Placement
+	if current == "" {
+		current = PlacementHomeHero
+	}
+	if current != placement {
+		return false
+	}
+	if placement != PlacementCategory || categoryID == "" || len(a.CategoryIDs) == 0 {
+		return true
+	}
+	return slices.Contains(a.CategoryIDs, categoryID)
+}
+
+// sortAdvertises orders advertises by priority, lowest first, then by name.
+func sortAdvertises(advertises []ClientAdvertise) {
+	sort.SliceStable(advertises, func(i, j int) bool {
+		if advertises[i].Priority != advertises[j].Priority {
+			return advertises[i].Priority < advertises[j].Priority
+		}
+		return advertises[i].Name < advertises[j].Name
+	})
+}
+
+// scheduleState reports where now falls in the display window. A missing start_at or end_at leaves
+// that side of the window open, and end_at itself is already expired.
+func scheduleState(startAt, endAt *time.Time, now time.Time) string {
+	if startAt != nil && now.Before(*startAt) {
+		return StateScheduled
+	}
+	if endAt != nil && !now.Before(*endAt) {
+		return StateExpired
+	}
+	return StateLive
+}
+
+// validSchedule reports whether the display window is not empty.
+func validSchedule(startAt, endAt *time.Time) bool {
+	return startAt == nil || endAt == nil || endAt.After(*startAt)
+}
+
+// filterAdvertises keeps the advertises of the admin listing that are not in the trash and match
+// state and placement at now, sorted by placement and priority. Empty filters match everything.
+func filterAdvertises(advertises []Advertise, state, placement string, now time.Time) []Advertise {
+	var filtered []Advertise
+	for _, advertise := range advertises {
+		if advertise.DeletedAt != nil {
+			continue
+		}
+		if advertise.Placement == "" {
+			advertise.Placement = PlacementHomeHero
+		}
+		if placement != "" && advertise.Placement != placement {
+			continue
+		}
+		advertise.State = scheduleState(advertise.StartAt, advertise.EndAt, now)
+		if state != "" && advertise.State != state {
+			continue
+		}
+		filtered = append(filtered, advertise)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if filtered[i].Placement != filtered[j].Placement {
+			return filtered[i].Placement < filtered[j].Placement
+		}
+		if filtered[i].Priority != filtered[j].Priority {
+			return filtered[i].Priority < filtered[j].Priority
+		}
+		return filtered[i].Name < filtered[j].Name
+	})
+	return filtered
+}
+
+// liveAdvertises keeps the enabled advertises that are on display at now in placement, sorted by
+// priority. An empty placement keeps every placement. Older advertises get the defaults filled in.
+func liveAdvertises(advertises []ClientAdvertise, placement, categoryID string, now time.Time) []ClientAdvertise {
+	var live []ClientAdvertise
+	for _, advertise := range advertises {
+		if scheduleState(advertise.StartAt, advertise.EndAt, now) != StateLive {
+			continue
+		}
+		if placement != "" && !advertise.showsOn(placement, categoryID) {
+			continue
+		}
+		if advertise.Placement == "" {
+			advertise.Placement = PlacementHomeHero
+		}
+		if advertise.MobileImage == "" {
+			advertise.MobileImage = advertise.Image
+		}
+		live = append(live, advertise)
+	}
+	sortAdvertises(live)
+	return live
 }
 
 // Service provides advertise operations.
 type Service interface {
 	// Admin operations
 	AdminCreateAdvertise(ctx context.Context, advertise Advertise) (Advertise, error)
-	AdminGetAdvertises(ctx context.Context, page, pageSize int, search string) ([]Advertise, int, error)
+	AdminGetAdvertises(ctx context.Context, page, pageSize int, search, state, placement string) ([]Advertise, int, error)
 	AdminGetAdvertise(ctx context.Context, id string) (Advertise, error)
-	AdminUpdateAdvertise(ctx context.Context, id string, advertise Advertise) (Advertise, error)
+	AdminUpdateAdvertise(ctx context.Context, id, version string, advertise Advertise) (Advertise, error)
+	AdminPatchAdvertise(ctx context.Context, id, version string, fields map[string]interface{}) (Advertise, error)
 	AdminDeleteAdvertise(ctx context.Context, id string) error
+	AdminReorderAdvertises(ctx context.Context, ids []string) error
+	AdminGetDeletedAdvertises(ctx context.Context, page, pageSize int) ([]Advertise, int, error)
+	AdminRestoreAdvertise(ctx context.Context, id string) (Advertise, error)
+	PurgeDeletedAdvertises(ctx context.Context, before time.Time) (int, error)
+	AdminGetStats(ctx context.Context, from, to time.Time) ([]AdvertiseStats, error)
 
 	// Client operations
-	GetAdvertises(ctx context.Context) ([]ClientAdvertise, error)
+	// GetAdvertises returns the enabled advertises whose display window contains the current time,
+	// sorted by priority. A non-empty placement keeps only that slot, narrowed to categoryID on category pages.
+	GetAdvertises(ctx context.Context, placement, categoryID string) ([]ClientAdvertise, error)
+	// ClickTarget returns where a click on the advertise goes; RecordClick counts the click.
+	ClickTarget(ctx context.Context, id string) (Target, error)
+	RecordClick(ctx context.Context, id string) error
+	RecordImpressions(ctx context.Context, ids []string) error
 }
@@ -0,0 +1,143 @@
+package advertise
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestScheduleState(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name           string
+		startAt, endAt *time.Time
+		want           string
+	}{
+		{"open window", nil, nil, StateLive},
+		{"started", &before, nil, StateLive},
+		{"starts now", &now, nil, StateLive},
+		{"not started", &after, nil, StateScheduled},
+		{"not ended", nil, &after, StateLive},
+		{"ends now", nil, &now, StateExpired},
+		{"ended", nil, &before, StateExpired},
+		{"inside window", &before, &after, StateLive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scheduleState(tt.startAt, tt.endAt, now); got != tt.want {
+				t.Errorf("scheduleState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidSchedule(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+
+	tests := []struct {
+		name           string
+		startAt, endAt *time.Time
+		want           bool
+	}{
+		{"open window", nil, nil, true},
+		{"start only", &start, nil, true},
+		{"end only", nil, &end, true},
+		{"end after start", &start, &end, true},
+		{"end equals start", &start, &start, false},
+		{"end before start", &end, &start, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validSchedule(tt.startAt, tt.endAt); got != tt.want {
+				t.Errorf("validSchedule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterAdvertises(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	deleted := before
+	advertises := []Advertise{
+		{ID: "legacy", Name: "B", Priority: 1},
+		{ID: "first", Name: "A", Priority: 1},
+		{ID: "top", Name: "Z", Priority: 0},
+		{ID: "category", Placement: PlacementCategory},
+		{ID: "scheduled", StartAt: &after},
+		{ID: "expired", EndAt: &before},
+		{ID: "trashed", DeletedAt: &deleted},
+	}
+
+	tests := []struct {
+		name      string
+		state     string
+		placement string
+		want      []string
+	}{
+		{"everything but the trash", "", "", []string{"category", "scheduled", "expired", "top", "first", "legacy"}},
+		{"live", StateLive, "", []string{"category", "top", "first", "legacy"}},
+		{"scheduled", StateScheduled, "", []string{"scheduled"}},
+		{"expired", StateExpired, "", []string{"expired"}},
+		{"placement", "", PlacementCategory, []string{"category"}},
+		{"older advertises are home hero", StateLive, PlacementHomeHero, []string{"top", "first", "legacy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, advertise := range filterAdvertises(advertises, tt.state, tt.placement, now) {
+				got = append(got, advertise.ID)
+				if want := scheduleState(advertise.StartAt, advertise.EndAt, now); advertise.State != want {
+					t.Errorf("%s state = %q, want %q", advertise.ID, advertise.State, want)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("filterAdvertises() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiveAdvertises(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	advertises := []ClientAdvertise{
+		{ID: "legacy", Name: "B", Priority: 1, Image: "wide.jpg"},
+		{ID: "top", Name: "A", Priority: 0, StartAt: &before, EndAt: &after},
+		{ID: "scheduled", StartAt: &after},
+		{ID: "ends now", EndAt: &now},
+		{ID: "tea", Placement: PlacementCategory, CategoryIDs: []string{"tea"}},
+		{ID: "all categories", Placement: PlacementCategory},
+	}
+
+	tests := []struct {
+		name       string
+		placement  string
+		categoryID string
+		want       []string
+	}{
+		{"every placement", "", "", []string{"tea", "all categories", "top", "legacy"}},
+		{"home hero", PlacementHomeHero, "", []string{"top", "legacy"}},
+		{"category page", PlacementCategory, "tea", []string{"tea", "all categories"}},
+		{"other category page", PlacementCategory, "coffee", []string{"all categories"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, advertise := range liveAdvertises(advertises, tt.placement, tt.categoryID, now) {
+				got = append(got, advertise.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("liveAdvertises() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	live := liveAdvertises(advertises, PlacementHomeHero, "", now)
+	if legacy := live[1]; legacy.Placement != PlacementHomeHero || legacy.MobileImage != "wide.jpg" {
+		t.Errorf("legacy advertise = %+v, want home hero placement and the wide image on mobile", legacy)
+	}
+}
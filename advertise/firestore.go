@@ -2,39 +2,72 @@ package advertise
 
 import (
 	"context"
+	"errors"
 	"log"
+	"slices"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
 )
 
 // FirestoreService is a Firestore implementation of the advertise service.
+// now is the clock that display windows and stats days are checked against.
 type FirestoreService struct {
-	client     *firestore.Client
-	collection string
+	client          *firestore.Client
+	collection      string
+	statsCollection string
+	now             func() time.Time
 }
 
 // NewFirestoreService creates a new Firestore-backed advertise service.
 func NewFirestoreService(client *firestore.Client) *FirestoreService {
 	return &FirestoreService{
-		client:     client,
-		collection: "advertises",
+		client:          client,
+		collection:      "advertises",
+		statsCollection: "advertise_stats",
+		now:             time.Now,
 	}
 }
 
 func (s *FirestoreService) AdminCreateAdvertise(ctx context.Context, advertise Advertise) (Advertise, error) {
+	if err := validateAdvertise(&advertise); err != nil {
+		return Advertise{}, err
+	}
 	ref := s.client.Collection(s.collection).NewDoc()
 	advertise.ID = ref.ID
+	now, actor := time.Now(), auth.Actor(ctx)
+	advertise.CreatedAt, advertise.UpdatedAt = now, now
+	advertise.CreatedBy, advertise.UpdatedBy = actor, actor
 
-	_, err := ref.Set(ctx, advertise)
+	wr, err := ref.Set(ctx, advertise)
 	if err != nil {
 		log.Printf("Failed to create advertise: %v", err)
 		return Advertise{}, err
 	}
+	advertise.Version = etag.Version(wr.UpdateTime)
+	advertise.State = scheduleState(advertise.StartAt, advertise.EndAt, s.now())
 	return advertise, nil
 }
 
-func (s *FirestoreService) AdminGetAdvertises(ctx context.Context, page, pageSize int, search string) ([]Advertise, int, error) {
+// AdminGetAdvertises lists advertises that are not in the trash, sorted by placement and priority.
+// A non-empty state keeps only those whose display window is in that state, and a non-empty placement
+// only that slot. Both filters run in memory: state depends on the current time, and advertises saved
+// before placements existed have no placement field to query.
+func (s *FirestoreService) AdminGetAdvertises(ctx context.Context, page, pageSize int, search, state, placement string) ([]Advertise, int, error) {
+	switch state {
+	case "", StateScheduled, StateLive, StateExpired:
+	default:
+		return nil, 0, ErrInvalidState
+	}
+	if placement != "" && !slices.Contains(Placements, placement) {
+		return nil, 0, ErrInvalidPlacement
+	}
+
 	var advertises []Advertise
 	query := s.client.Collection(s.collection).Query
 	if search != "" {
@@ -53,8 +86,10 @@ func (s *FirestoreService) AdminGetAdvertises(ctx context.Context, page, pageSiz
 		}
 		var advertise Advertise
 		doc.DataTo(&advertise)
+		advertise.Version = etag.Version(doc.UpdateTime)
 		advertises = append(advertises, advertise)
 	}
+	advertises = filterAdvertises(advertises, state, placement, s.now())
 
 	totalCount := len(advertises)
 	start := (page - 1) * pageSize
@@ -81,26 +116,296 @@ func (s *FirestoreService) AdminGetAdvertise(ctx context.Context, id string) (Ad
 	if err := doc.DataTo(&advertise); err != nil {
 		return Advertise{}, err
 	}
+	if advertise.Placement == "" {
+		advertise.Placement = PlacementHomeHero
+	}
+	advertise.Version = etag.Version(doc.UpdateTime)
+	advertise.State = scheduleState(advertise.StartAt, advertise.EndAt, s.now())
 	return advertise, nil
 }
 
-func (s *FirestoreService) AdminUpdateAdvertise(ctx context.Context, id string, advertise Advertise) (Advertise, error) {
+func (s *FirestoreService) AdminUpdateAdvertise(ctx context.Context, id, version string, advertise Advertise) (Advertise, error) {
+	if err := validateAdvertise(&advertise); err != nil {
+		return Advertise{}, err
+	}
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Advertise{}, err
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
 	advertise.ID = id
-	_, err := s.client.Collection(s.collection).Doc(id).Set(ctx, advertise)
+
+	// PUT replaces the whole document, but only if it exists and has not changed since it was read.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+
+		// Creation stamps always come from the stored document, never from the request.
+		var existing Advertise
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrAdvertiseNotFound
+		}
+		advertise.CreatedAt, advertise.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		advertise.DeletedAt, advertise.DeletedBy = nil, ""
+		advertise.UpdatedAt, advertise.UpdatedBy = time.Now(), auth.Actor(ctx)
+		return tx.Set(ref, advertise)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrAdvertiseNotFound) {
+		return Advertise{}, ErrAdvertiseNotFound
+	}
 	if err != nil {
+		log.Printf("Failed to update advertise: %v", err)
 		return Advertise{}, err
 	}
-	return advertise, nil
+	return s.AdminGetAdvertise(ctx, id)
 }
 
+func (s *FirestoreService) AdminPatchAdvertise(ctx context.Context, id, version string, fields map[string]interface{}) (Advertise, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Advertise{}, err
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
+
+	_, hasStart := fields["start_at"]
+	_, hasEnd := fields["end_at"]
+	updates := []firestore.Update{
+		{Path: "updated_at", Value: time.Now()},
+		{Path: "updated_by", Value: auth.Actor(ctx)},
+	}
+	for key, value := range fields {
+		updates = append(updates, firestore.Update{Path: key, Value: value})
+	}
+
+	// Update only touches the given paths; like PUT it needs the document to be unchanged and not in the trash.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+		var existing Advertise
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrAdvertiseNotFound
+		}
+
+		// A window edge is checked against the stored other edge.
+		if hasStart || hasEnd {
+			startAt, endAt := existing.StartAt, existing.EndAt
+			if hasStart {
+				startAt = timeField(fields["start_at"])
+			}
+			if hasEnd {
+				endAt = timeField(fields["end_at"])
+			}
+			if !validSchedule(startAt, endAt) {
+				return ErrInvalidSchedule
+			}
+		}
+		return tx.Update(ref, updates)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrAdvertiseNotFound) {
+		return Advertise{}, ErrAdvertiseNotFound
+	}
+	if errors.Is(err, ErrInvalidSchedule) {
+		return Advertise{}, err
+	}
+	if err != nil {
+		log.Printf("Failed to patch advertise: %v", err)
+		return Advertise{}, err
+	}
+
+	return s.AdminGetAdvertise(ctx, id)
+}
+
+// AdminDeleteAdvertise moves the advertise to the trash; PurgeDeletedAdvertises removes it for good.
 func (s *FirestoreService) AdminDeleteAdvertise(ctx context.Context, id string) error {
-	_, err := s.client.Collection(s.collection).Doc(id).Delete(ctx)
-	return err
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var advertise Advertise
+		if err := doc.DataTo(&advertise); err != nil {
+			return err
+		}
+		if advertise.DeletedAt != nil {
+			return ErrAdvertiseNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: time.Now()},
+			{Path: "deleted_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrAdvertiseNotFound) {
+		return ErrAdvertiseNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to delete advertise: %v", err)
+		return err
+	}
+	return nil
 }
 
-func (s *FirestoreService) GetAdvertises(ctx context.Context) ([]ClientAdvertise, error) {
+// AdminReorderAdvertises sets priority of the given advertises to their position in ids.
+func (s *FirestoreService) AdminReorderAdvertises(ctx context.Context, ids []string) error {
+	refs := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		refs[i] = s.client.Collection(s.collection).Doc(id)
+	}
+
+	now, actor := time.Now(), auth.Actor(ctx)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.GetAll(refs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if !doc.Exists() {
+				return ErrAdvertiseNotFound
+			}
+			var advertise Advertise
+			if err := doc.DataTo(&advertise); err != nil {
+				return err
+			}
+			if advertise.DeletedAt != nil {
+				return ErrAdvertiseNotFound
+			}
+		}
+		for i, ref := range refs {
+			err := tx.Update(ref, []firestore.Update{
+				{Path: "priority", Value: i},
+				{Path: "updated_at", Value: now},
+				{Path: "updated_by", Value: actor},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrAdvertiseNotFound) {
+		return ErrAdvertiseNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to reorder advertises: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *FirestoreService) AdminGetDeletedAdvertises(ctx context.Context, page, pageSize int) ([]Advertise, int, error) {
+	var advertises []Advertise
+	query := s.client.Collection(s.collection).Where("deleted_at", "!=", nil).OrderBy("deleted_at", firestore.Desc)
+
+	iter := query.Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted advertises: %v", err)
+			return nil, 0, err
+		}
+		var advertise Advertise
+		doc.DataTo(&advertise)
+		advertise.Version = etag.Version(doc.UpdateTime)
+		advertises = append(advertises, advertise)
+	}
+
+	totalCount := len(advertises)
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Advertise{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	return advertises[start:end], totalCount, nil
+}
+
+func (s *FirestoreService) AdminRestoreAdvertise(ctx context.Context, id string) (Advertise, error) {
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var advertise Advertise
+		if err := doc.DataTo(&advertise); err != nil {
+			return err
+		}
+		if advertise.DeletedAt == nil {
+			return ErrAdvertiseNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: nil},
+			{Path: "deleted_by", Value: firestore.Delete},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrAdvertiseNotFound) {
+		return Advertise{}, ErrAdvertiseNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to restore advertise: %v", err)
+		return Advertise{}, err
+	}
+	return s.AdminGetAdvertise(ctx, id)
+}
+
+// PurgeDeletedAdvertises permanently removes advertises that were moved to the trash before the given time.
+func (s *FirestoreService) PurgeDeletedAdvertises(ctx context.Context, before time.Time) (int, error) {
+	iter := s.client.Collection(s.collection).Where("deleted_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted advertises: %v", err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge advertise %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (s *FirestoreService) GetAdvertises(ctx context.Context, placement, categoryID string) ([]ClientAdvertise, error) {
+	if placement != "" && !slices.Contains(Placements, placement) {
+		return nil, ErrInvalidPlacement
+	}
+
 	var advertises []ClientAdvertise
-	query := s.client.Collection(s.collection).Where("is_enabled", "==", true)
+	// The window and placement are checked in memory, so older banners without those fields need no backfill.
+	query := s.client.Collection(s.collection).Where("is_enabled", "==", true).Where("deleted_at", "==", nil)
 	iter := query.Documents(ctx)
 	for {
 		doc, err := iter.Next()
@@ -115,5 +420,14 @@ func (s *FirestoreService) GetAdvertises(ctx context.Context) ([]ClientAdvertise
 		doc.DataTo(&advertise)
 		advertises = append(advertises, advertise)
 	}
-	return advertises, nil
+	return liveAdvertises(advertises, placement, categoryID, s.now()), nil
+}
+
+// timeField converts a validated patch value of a timestamp field, where nil clears it.
+func timeField(value interface{}) *time.Time {
+	t, ok := value.(time.Time)
+	if !ok {
+		return nil
+	}
+	return &t
 }
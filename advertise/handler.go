@@ -1,21 +1,53 @@
 package advertise
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
 	"suto-e-shop-api/pkg/pagination"
+	"suto-e-shop-api/pkg/patch"
+	"suto-e-shop-api/product"
 )
 
-// Handler holds the advertise service.
+// advertisePatchRules lists the fields a PATCH request may change.
+var advertisePatchRules = map[string]patch.Rule{
+	"name":         patch.RequiredString(),
+	"image":        patch.String(),
+	"mobile_image": patch.String(),
+	"target":       targetRule,
+	"is_enabled":   patch.Bool(),
+	"placement":    patch.OneOf(Placements...),
+	"priority":     patch.Int(0, math.MaxInt32),
+	"category_ids": patch.Strings(),
+	"start_at":     patch.Time(),
+	"end_at":       patch.Time(),
+}
+
+// Handler holds the advertise service and the lookups for link targets.
+// storefrontURL is where clicks on product, category and collection targets are redirected to.
 type Handler struct {
-	service Service
+	service       Service
+	products      ProductResolver
+	categories    CategoryResolver
+	storefrontURL string
 }
 
 // NewHandler creates a new advertise handler.
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service Service, products ProductResolver, categories CategoryResolver, storefrontURL string) *Handler {
+	return &Handler{
+		service:       service,
+		products:      products,
+		categories:    categories,
+		storefrontURL: strings.TrimRight(storefrontURL, "/"),
+	}
 }
 
 // RegisterAdminRoutes registers the admin advertise routes to the router.
@@ -24,14 +56,21 @@ func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
 
 	adminRouter.HandleFunc("", h.AdminCreateAdvertise).Methods("POST")
 	adminRouter.HandleFunc("", h.AdminGetAdvertises).Methods("GET")
+	adminRouter.HandleFunc("/trash", h.AdminGetDeletedAdvertises).Methods("GET")
+	adminRouter.HandleFunc("/order", h.AdminReorderAdvertises).Methods("PUT")
+	adminRouter.HandleFunc("/stats", h.AdminGetStats).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.AdminGetAdvertise).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.AdminUpdateAdvertise).Methods("PUT")
+	adminRouter.HandleFunc("/{id}", h.AdminPatchAdvertise).Methods("PATCH")
 	adminRouter.HandleFunc("/{id}", h.AdminDeleteAdvertise).Methods("DELETE")
+	adminRouter.HandleFunc("/{id}/restore", h.AdminRestoreAdvertise).Methods("POST")
 }
 
 // RegisterClientRoutes registers the client advertise routes to the router.
 func (h *Handler) RegisterClientRoutes(router *mux.Router) {
 	router.HandleFunc("/advertises", h.GetAdvertises).Methods("GET")
+	router.HandleFunc("/advertises/impressions", h.RecordImpressions).Methods("POST")
+	router.HandleFunc("/advertises/{id}/click", h.ClickAdvertise).Methods("GET")
 }
 
 func (h *Handler) AdminCreateAdvertise(w http.ResponseWriter, r *http.Request) {
@@ -40,21 +79,35 @@ func (h *Handler) AdminCreateAdvertise(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if h.respondIfInvalidTarget(w, r, advertise.Target) {
+		return
+	}
 
 	createdAdvertise, err := h.service.AdminCreateAdvertise(r.Context(), advertise)
+	if errors.Is(err, ErrInvalidSchedule) || errors.Is(err, ErrInvalidPlacement) || errors.Is(err, ErrInvalidTarget) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	etag.SetHeader(w, createdAdvertise.Version)
 	RespondWithJSON(w, http.StatusCreated, Response{Data: createdAdvertise, Message: "success", Code: 0})
 }
 
 func (h *Handler) AdminGetAdvertises(w http.ResponseWriter, r *http.Request) {
 	page, pageSize := pagination.GetPaginationParams(r)
 	search := r.URL.Query().Get("search")
+	state := r.URL.Query().Get("state")
+	placement := r.URL.Query().Get("placement")
 
-	advertises, totalCount, err := h.service.AdminGetAdvertises(r.Context(), page, pageSize, search)
+	advertises, totalCount, err := h.service.AdminGetAdvertises(r.Context(), page, pageSize, search, state, placement)
+	if errors.Is(err, ErrInvalidState) || errors.Is(err, ErrInvalidPlacement) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -80,6 +133,7 @@ func (h *Handler) AdminGetAdvertise(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, advertise.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: advertise, Message: "success", Code: 0})
 }
 
@@ -87,18 +141,87 @@ func (h *Handler) AdminUpdateAdvertise(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
 	var advertise Advertise
 	if err := json.NewDecoder(r.Body).Decode(&advertise); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if h.respondIfInvalidTarget(w, r, advertise.Target) {
+		return
+	}
+
+	updatedAdvertise, err := h.service.AdminUpdateAdvertise(r.Context(), id, version, advertise)
+	if errors.Is(err, ErrAdvertiseNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Advertise not found")
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidSchedule) || errors.Is(err, ErrInvalidPlacement) || errors.Is(err, ErrInvalidTarget) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedAdvertise.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedAdvertise, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminPatchAdvertise(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
 
-	updatedAdvertise, err := h.service.AdminUpdateAdvertise(r.Context(), id, advertise)
+	fields, err := patch.Validate(data, advertisePatchRules)
 	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if target, ok := fields["target"].(Target); ok && h.respondIfInvalidTarget(w, r, &target) {
+		return
+	}
+
+	updatedAdvertise, err := h.service.AdminPatchAdvertise(r.Context(), id, version, fields)
+	if errors.Is(err, ErrAdvertiseNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Advertise not found")
 		return
 	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidSchedule) || errors.Is(err, ErrInvalidPlacement) || errors.Is(err, ErrInvalidTarget) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	etag.SetHeader(w, updatedAdvertise.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: updatedAdvertise, Message: "success", Code: 0})
 }
 
@@ -106,16 +229,143 @@ func (h *Handler) AdminDeleteAdvertise(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := h.service.AdminDeleteAdvertise(r.Context(), id); err != nil {
+	err := h.service.AdminDeleteAdvertise(r.Context(), id)
+	if errors.Is(err, ErrAdvertiseNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Advertise not found")
 		return
 	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
 }
 
+// AdminReorderAdvertises takes {"ids": [...]} and sets their priority to that order.
+func (h *Handler) AdminReorderAdvertises(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(body.IDs) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	if len(body.IDs) > MaxReorderIds {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("too many advertise ids, at most %d allowed", MaxReorderIds))
+		return
+	}
+	seen := make(map[string]bool, len(body.IDs))
+	for _, id := range body.IDs {
+		if id == "" || seen[id] {
+			RespondWithError(w, http.StatusBadRequest, "ids must be unique and non-empty")
+			return
+		}
+		seen[id] = true
+	}
+
+	err := h.service.AdminReorderAdvertises(r.Context(), body.IDs)
+	if errors.Is(err, ErrAdvertiseNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Advertise not found")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
+}
+
+// AdminGetStats reports impressions, clicks and CTR per advertise between ?from= and ?to=
+// (YYYY-MM-DD, both inclusive). The range defaults to the last 30 days.
+func (h *Handler) AdminGetStats(w http.ResponseWriter, r *http.Request) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -29)
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = ParseStatsDate(value); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "from must be a date like 2006-01-02")
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = ParseStatsDate(value); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "to must be a date like 2006-01-02")
+			return
+		}
+	}
+
+	stats, err := h.service.AdminGetStats(r.Context(), from, to)
+	if errors.Is(err, ErrInvalidDateRange) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Data: stats, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminGetDeletedAdvertises(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := pagination.GetPaginationParams(r)
+
+	advertises, totalCount, err := h.service.AdminGetDeletedAdvertises(r.Context(), page, pageSize)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       advertises,
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
+}
+
+func (h *Handler) AdminRestoreAdvertise(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	advertise, err := h.service.AdminRestoreAdvertise(r.Context(), id)
+	if errors.Is(err, ErrAdvertiseNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Advertise not found in trash")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, advertise.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: advertise, Message: "success", Code: 0})
+}
+
+// GetAdvertises lists the live advertises, e.g. ?placement=home_hero for the homepage carousel
+// or ?placement=category&category_id=... for one category page.
 func (h *Handler) GetAdvertises(w http.ResponseWriter, r *http.Request) {
-	advertises, err := h.service.GetAdvertises(r.Context())
+	placement := r.URL.Query().Get("placement")
+	categoryID := r.URL.Query().Get("category_id")
+
+	advertises, err := h.service.GetAdvertises(r.Context(), placement, categoryID)
+	if errors.Is(err, ErrInvalidPlacement) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	advertises, err = h.resolveTargets(r.Context(), advertises)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -123,3 +373,169 @@ func (h *Handler) GetAdvertises(w http.ResponseWriter, r *http.Request) {
 
 	RespondWithJSON(w, http.StatusOK, Response{Data: advertises, Message: "success", Code: 0})
 }
+
+// ClickAdvertise counts a click and redirects the visitor to the advertise link. A link to a product
+// or category the listing would hide is a 404 as well, since a cached banner can outlive its target.
+func (h *Handler) ClickAdvertise(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	target, err := h.service.ClickTarget(r.Context(), id)
+	if errors.Is(err, ErrAdvertiseNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Advertise not found")
+		return
+	}
+	if errors.Is(err, ErrNoLink) {
+		RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resolved, err := h.resolveTargets(r.Context(), []ClientAdvertise{{Target: &target}})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(resolved) == 0 {
+		RespondWithError(w, http.StatusNotFound, "Advertise target is no longer available")
+		return
+	}
+
+	// A lost count must not keep the visitor from reaching the target; RecordClick logs it.
+	h.service.RecordClick(r.Context(), id)
+
+	// Every click has to reach the server to be counted.
+	w.Header().Set("Cache-Control", "no-store")
+	link := target.Path()
+	if target.Type != TargetURL {
+		link = h.storefrontURL + link
+	}
+	http.Redirect(w, r, link, http.StatusFound)
+}
+
+// RecordImpressions is the beacon the storefront calls with {"ids": [...]} for the advertises it showed.
+// The body is read regardless of Content-Type, since navigator.sendBeacon sends strings as text/plain.
+func (h *Handler) RecordImpressions(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&body); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(body.IDs) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	if len(body.IDs) > MaxImpressionIds {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("too many advertise ids, at most %d allowed", MaxImpressionIds))
+		return
+	}
+	// A banner counts once per beacon even if the carousel showed it twice.
+	seen := make(map[string]bool, len(body.IDs))
+	ids := make([]string, 0, len(body.IDs))
+	for _, id := range body.IDs {
+		if id == "" || strings.Contains(id, "/") {
+			RespondWithError(w, http.StatusBadRequest, "ids must be advertise ids")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if err := h.service.RecordImpressions(r.Context(), ids); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondIfInvalidTarget writes a 400 and returns true when the target is malformed or points at a
+// product or category that does not exist. Disabled ones are accepted; the storefront hides them.
+func (h *Handler) respondIfInvalidTarget(w http.ResponseWriter, r *http.Request, target *Target) bool {
+	if target == nil {
+		return false
+	}
+	if err := target.validate(); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return true
+	}
+
+	found := true
+	switch target.Type {
+	case TargetProduct:
+		result, err := h.products.GetProductsIds(r.Context(), []string{target.Value})
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		found = len(result.MissingIDs) == 0
+	case TargetCategory:
+		var err error
+		_, found, err = h.categories.CategoryName(r.Context(), target.Value)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return true
+		}
+	}
+	if !found {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownTarget.Error())
+		return true
+	}
+	return false
+}
+
+// resolveTargets fills in the storefront path of each advertise and drops those whose product or
+// category is no longer shown on the storefront.
+func (h *Handler) resolveTargets(ctx context.Context, advertises []ClientAdvertise) ([]ClientAdvertise, error) {
+	var productIDs []string
+	hasCategories := false
+	for _, advertise := range advertises {
+		if advertise.Target == nil {
+			continue
+		}
+		switch advertise.Target.Type {
+		case TargetProduct:
+			productIDs = append(productIDs, advertise.Target.Value)
+		case TargetCategory:
+			hasCategories = true
+		}
+	}
+
+	enabledProducts := map[string]bool{}
+	for start := 0; start < len(productIDs); start += product.MaxProductsIds {
+		end := min(start+product.MaxProductsIds, len(productIDs))
+		result, err := h.products.GetProductsIds(ctx, productIDs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.Products {
+			enabledProducts[p.ID] = true
+		}
+	}
+	visibleCategories := map[string]bool{}
+	if hasCategories {
+		var err error
+		if visibleCategories, err = h.categories.VisibleCategoryIDs(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	resolved := make([]ClientAdvertise, 0, len(advertises))
+	for _, advertise := range advertises {
+		if target := advertise.Target; target != nil {
+			if (target.Type == TargetProduct && !enabledProducts[target.Value]) ||
+				(target.Type == TargetCategory && !visibleCategories[target.Value]) {
+				continue
+			}
+			advertise.Path = target.Path()
+			advertise.IsExternal = target.Type == TargetURL
+		}
+		resolved = append(resolved, advertise)
+	}
+	return resolved, nil
+}
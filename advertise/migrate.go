@@ -0,0 +1,69 @@
+package advertise
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// MigrateLinkTargets turns the free-form link of older advertises into a typed target.
+// Storefront paths like /products/<id> become product, category or collection targets and absolute
+// URLs become url targets. Links that match neither are logged and left in place to fix by hand.
+// Documents that are already converted are skipped, so it is safe to run more than once.
+func (s *FirestoreService) MigrateLinkTargets(ctx context.Context) (int, error) {
+	iter := s.client.Collection(s.collection).Documents(ctx)
+	defer iter.Stop()
+
+	migrated := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to read advertises for migration: %v", err)
+			return migrated, err
+		}
+
+		link, ok := doc.Data()["link"].(string)
+		if !ok {
+			continue
+		}
+		updates := []firestore.Update{{Path: "link", Value: firestore.Delete}}
+		if link != "" {
+			target, ok := linkTarget(link)
+			if !ok {
+				log.Printf("Advertise %s has a link that is not a known path or URL, set its target by hand: %q", doc.Ref.ID, link)
+				continue
+			}
+			updates = append(updates, firestore.Update{Path: "target", Value: target})
+		}
+		if _, err := doc.Ref.Update(ctx, updates, firestore.LastUpdateTime(doc.UpdateTime)); err != nil {
+			log.Printf("Failed to migrate advertise %s: %v", doc.Ref.ID, err)
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// linkTarget maps a legacy link onto the target it stands for.
+func linkTarget(link string) (Target, bool) {
+	link = strings.TrimSpace(link)
+	prefixes := map[string]string{
+		"/products/":    TargetProduct,
+		"/categories/":  TargetCategory,
+		"/collections/": TargetCollection,
+	}
+	for prefix, targetType := range prefixes {
+		if value, ok := strings.CutPrefix(link, prefix); ok {
+			target := Target{Type: targetType, Value: strings.TrimSuffix(value, "/")}
+			return target, target.validate() == nil
+		}
+	}
+	target := Target{Type: TargetURL, Value: link}
+	return target, target.validate() == nil
+}
@@ -0,0 +1,266 @@
+package advertise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// statShards is how many counter documents each advertise has per day. Firestore sustains
+	// about one write per second on a single document, so hits are spread over the shards.
+	statShards = 10
+	// dateLayout is the format of the days in the stats collection and in stats requests.
+	dateLayout = "2006-01-02"
+	// MaxImpressionIds is the most advertises a single impression beacon may report.
+	MaxImpressionIds = 50
+	// MaxStatsDays is the longest date range the stats endpoint accepts.
+	MaxStatsDays = 366
+)
+
+var (
+	// ErrNoLink is returned when clicking an advertise that has nowhere to go.
+	ErrNoLink = errors.New("advertise has no link")
+	// ErrInvalidDateRange is returned when the stats range is reversed or too long.
+	ErrInvalidDateRange = fmt.Errorf("invalid date range, from must not be after to and the range must be at most %d days", MaxStatsDays)
+)
+
+// statsLocation is the time zone that days are counted in, matching the shop's business day.
+var statsLocation = time.FixedZone("Asia/Taipei", 8*60*60)
+
+// DailyStats holds the counters of one advertise on one day.
+type DailyStats struct {
+	Date        string  `json:"date"`
+	Impressions int64   `json:"impressions"`
+	Clicks      int64   `json:"clicks"`
+	CTR         float64 `json:"ctr"`
+}
+
+// AdvertiseStats holds the counters of one advertise over a date range.
+// CTR is clicks divided by impressions, or 0 when there were no impressions.
+type AdvertiseStats struct {
+	AdvertiseID string       `json:"advertise_id"`
+	Name        string       `json:"name"`
+	Impressions int64        `json:"impressions"`
+	Clicks      int64        `json:"clicks"`
+	CTR         float64      `json:"ctr"`
+	Days        []DailyStats `json:"days"`
+}
+
+// statShard is one counter document in the stats collection.
+type statShard struct {
+	AdvertiseID string `firestore:"advertise_id"`
+	Date        string `firestore:"date"`
+	Impressions int64  `firestore:"impressions"`
+	Clicks      int64  `firestore:"clicks"`
+}
+
+// ParseStatsDate parses a day of a stats request, e.g. 2026-10-19.
+func ParseStatsDate(value string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, value, statsLocation)
+}
+
+// ClickTarget returns the target of an advertise on display. Like impressions, clicks outside the
+// display window are not counted and the visitor gets a 404.
+func (s *FirestoreService) ClickTarget(ctx context.Context, id string) (Target, error) {
+	doc, err := s.client.Collection(s.collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Target{}, ErrAdvertiseNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to get advertise: %v", err)
+		return Target{}, err
+	}
+	var advertise Advertise
+	if err := doc.DataTo(&advertise); err != nil {
+		return Target{}, err
+	}
+	if advertise.DeletedAt != nil || !advertise.IsEnabled || scheduleState(advertise.StartAt, advertise.EndAt, s.now()) != StateLive {
+		return Target{}, ErrAdvertiseNotFound
+	}
+	if advertise.Target == nil {
+		return Target{}, ErrNoLink
+	}
+	return *advertise.Target, nil
+}
+
+// RecordClick counts one click on the advertise.
+func (s *FirestoreService) RecordClick(ctx context.Context, id string) error {
+	if err := s.incrementStat(ctx, id, "clicks"); err != nil {
+		log.Printf("Failed to record click on advertise %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// RecordImpressions counts one impression for each advertise in ids. Only advertises that are enabled
+// and inside their display window are counted, so the beacon cannot fill the stats collection with
+// made-up ids or inflate banners that the storefront never shows. The increments are written together.
+func (s *FirestoreService) RecordImpressions(ctx context.Context, ids []string) error {
+	refs := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		refs[i] = s.client.Collection(s.collection).Doc(id)
+	}
+	docs, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		log.Printf("Failed to get advertises: %v", err)
+		return err
+	}
+
+	now := s.now()
+	writer := s.client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var advertise Advertise
+		if err := doc.DataTo(&advertise); err != nil {
+			writer.End()
+			return err
+		}
+		if advertise.DeletedAt != nil || !advertise.IsEnabled || scheduleState(advertise.StartAt, advertise.EndAt, now) != StateLive {
+			continue
+		}
+		ref, data := s.statIncrement(doc.Ref.ID, "impressions")
+		job, err := writer.Set(ref, data, firestore.MergeAll)
+		if err != nil {
+			writer.End()
+			log.Printf("Failed to queue impression of advertise %s: %v", doc.Ref.ID, err)
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	writer.End()
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			log.Printf("Failed to record impressions: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// incrementStat adds one to field on a random shard of today's counters of the advertise.
+func (s *FirestoreService) incrementStat(ctx context.Context, id, field string) error {
+	ref, data := s.statIncrement(id, field)
+	_, err := ref.Set(ctx, data, firestore.MergeAll)
+	return err
+}
+
+// statIncrement returns a random shard of today's counters of the advertise and the merge that adds
+// one to field.
+func (s *FirestoreService) statIncrement(id, field string) (*firestore.DocumentRef, map[string]interface{}) {
+	date := s.now().In(statsLocation).Format(dateLayout)
+	shard := rand.IntN(statShards)
+	ref := s.client.Collection(s.statsCollection).Doc(fmt.Sprintf("%s_%s_%d", id, date, shard))
+	return ref, map[string]interface{}{
+		"advertise_id": id,
+		"date":         date,
+		field:          firestore.Increment(1),
+	}
+}
+
+// AdminGetStats sums the counters of every advertise that was seen between from and to, both days
+// inclusive, and returns them with the most impressions first.
+func (s *FirestoreService) AdminGetStats(ctx context.Context, from, to time.Time) ([]AdvertiseStats, error) {
+	fromDate, toDate := from.In(statsLocation).Format(dateLayout), to.In(statsLocation).Format(dateLayout)
+	if fromDate > toDate || to.Sub(from) >= MaxStatsDays*24*time.Hour {
+		return nil, ErrInvalidDateRange
+	}
+
+	// Only date is filtered, so the range query needs no composite index.
+	days := map[string]map[string]*DailyStats{}
+	iter := s.client.Collection(s.statsCollection).Where("date", ">=", fromDate).Where("date", "<=", toDate).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get advertise stats: %v", err)
+			return nil, err
+		}
+		var shard statShard
+		if err := doc.DataTo(&shard); err != nil {
+			return nil, err
+		}
+		if days[shard.AdvertiseID] == nil {
+			days[shard.AdvertiseID] = map[string]*DailyStats{}
+		}
+		day := days[shard.AdvertiseID][shard.Date]
+		if day == nil {
+			day = &DailyStats{Date: shard.Date}
+			days[shard.AdvertiseID][shard.Date] = day
+		}
+		day.Impressions += shard.Impressions
+		day.Clicks += shard.Clicks
+	}
+
+	stats := make([]AdvertiseStats, 0, len(days))
+	for id, byDate := range days {
+		stat := AdvertiseStats{AdvertiseID: id, Days: make([]DailyStats, 0, len(byDate))}
+		for _, day := range byDate {
+			day.CTR = ctr(day.Clicks, day.Impressions)
+			stat.Impressions += day.Impressions
+			stat.Clicks += day.Clicks
+			stat.Days = append(stat.Days, *day)
+		}
+		sort.Slice(stat.Days, func(i, j int) bool {
+			return stat.Days[i].Date < stat.Days[j].Date
+		})
+		stat.CTR = ctr(stat.Clicks, stat.Impressions)
+		stats = append(stats, stat)
+	}
+	if err := s.fillStatNames(ctx, stats); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Impressions != stats[j].Impressions {
+			return stats[i].Impressions > stats[j].Impressions
+		}
+		return stats[i].AdvertiseID < stats[j].AdvertiseID
+	})
+	return stats, nil
+}
+
+// fillStatNames looks up the names of the advertises; purged ones keep an empty name.
+func (s *FirestoreService) fillStatNames(ctx context.Context, stats []AdvertiseStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	refs := make([]*firestore.DocumentRef, len(stats))
+	for i, stat := range stats {
+		refs[i] = s.client.Collection(s.collection).Doc(stat.AdvertiseID)
+	}
+	docs, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		log.Printf("Failed to get advertises: %v", err)
+		return err
+	}
+	for i, doc := range docs {
+		if doc.Exists() {
+			stats[i].Name, _ = doc.Data()["name"].(string)
+		}
+	}
+	return nil
+}
+
+func ctr(clicks, impressions int64) float64 {
+	if impressions == 0 {
+		return 0
+	}
+	return float64(clicks) / float64(impressions)
+}
@@ -0,0 +1,103 @@
+package advertise
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"suto-e-shop-api/product"
+)
+
+// Target types an advertise can link to.
+const (
+	TargetProduct    = "product"
+	TargetCategory   = "category"
+	TargetCollection = "collection"
+	TargetURL        = "url"
+)
+
+var (
+	// ErrInvalidTarget is returned when a target has an unknown type or a malformed value.
+	ErrInvalidTarget = errors.New("invalid target, use type product, category, collection or url with a matching value")
+	// ErrUnknownTarget is returned when a target points at a product or category that does not exist.
+	ErrUnknownTarget = errors.New("target product or category does not exist")
+)
+
+// collectionSlug is the format of collection handles, e.g. summer-sale.
+var collectionSlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Target is where an advertise leads: a product or category ID, a collection handle or an external URL.
+// Collections are not stored by this API yet, so their handle is only checked for format.
+type Target struct {
+	Type  string `json:"type" firestore:"type"`
+	Value string `json:"value" firestore:"value"`
+}
+
+// validate checks the format of the target without looking anything up.
+func (t Target) validate() error {
+	switch t.Type {
+	case TargetProduct, TargetCategory:
+		if t.Value == "" || strings.Contains(t.Value, "/") {
+			return ErrInvalidTarget
+		}
+	case TargetCollection:
+		if !collectionSlug.MatchString(t.Value) {
+			return ErrInvalidTarget
+		}
+	case TargetURL:
+		u, err := url.Parse(t.Value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidTarget
+		}
+	default:
+		return ErrInvalidTarget
+	}
+	return nil
+}
+
+// Path returns the storefront path of the target, or the URL itself for external targets.
+func (t Target) Path() string {
+	switch t.Type {
+	case TargetProduct:
+		return "/products/" + url.PathEscape(t.Value)
+	case TargetCategory:
+		return "/categories/" + url.PathEscape(t.Value)
+	case TargetCollection:
+		return "/collections/" + t.Value
+	default:
+		return t.Value
+	}
+}
+
+// ProductResolver looks up the products advertises link to.
+type ProductResolver interface {
+	GetProductsIds(ctx context.Context, ids []string) (product.ProductsIdsResult, error)
+}
+
+// CategoryResolver looks up the categories advertises link to.
+type CategoryResolver interface {
+	// CategoryName returns the name of a category that exists and is not in the trash.
+	CategoryName(ctx context.Context, id string) (name string, found bool, err error)
+	// VisibleCategoryIDs returns the categories the storefront shows.
+	VisibleCategoryIDs(ctx context.Context) (map[string]bool, error)
+}
+
+// targetRule validates the target of a PATCH request; null removes the link.
+func targetRule(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidTarget
+	}
+	targetType, _ := fields["type"].(string)
+	targetValue, _ := fields["value"].(string)
+	target := Target{Type: targetType, Value: targetValue}
+	if len(fields) != 2 || target.validate() != nil {
+		return nil, ErrInvalidTarget
+	}
+	return target, nil
+}
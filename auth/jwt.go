@@ -6,8 +6,33 @@ import (
 	"strings"
 
 	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
 )
 
+type contextKey string
+
+// tokenContextKey is the context key under which the verified Firebase token is stored.
+const tokenContextKey contextKey = "firebaseToken"
+
+// TokenFromContext returns the Firebase token verified by FirebaseJWTMiddleware, if any.
+func TokenFromContext(ctx context.Context) (*auth.Token, bool) {
+	token, ok := ctx.Value(tokenContextKey).(*auth.Token)
+	return token, ok && token != nil
+}
+
+// Actor identifies the admin behind the request for created_by/updated_by stamps.
+// It prefers the e-mail claim and falls back to the UID; it is empty for unauthenticated requests.
+func Actor(ctx context.Context) string {
+	token, ok := TokenFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if email, ok := token.Claims["email"].(string); ok && email != "" {
+		return email
+	}
+	return token.UID
+}
+
 // FirebaseJWTMiddleware is a middleware function to protect routes using Firebase ID tokens.
 func FirebaseJWTMiddleware(fbApp *firebase.App) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -43,8 +68,8 @@ func FirebaseJWTMiddleware(fbApp *firebase.App) func(http.Handler) http.Handler
 				return
 			}
 
-			// You can add the decoded token to the request context if needed by other handlers
-			ctx := context.WithValue(r.Context(), "firebaseToken", token)
+			// Add the decoded token to the request context so services can stamp the acting admin
+			ctx := context.WithValue(r.Context(), tokenContextKey, token)
 			r = r.WithContext(ctx)
 
 			// Token is valid, proceed to the next handler
@@ -1,19 +1,62 @@
 package category
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrCategoryNotFound is returned when the requested category does not exist.
+	ErrCategoryNotFound = errors.New("category not found")
+	// ErrCategoryHasProducts is returned when deleting a category that products are still filed under.
+	ErrCategoryHasProducts = errors.New("category still has products, pass reassign_to to move them")
+	// ErrReassignTarget is returned when reassign_to is not a category the products can be moved to.
+	ErrReassignTarget = errors.New("reassign_to must be another existing category")
+)
+
+// MaxReorderIds is the most categories a single reorder request may contain.
+const MaxReorderIds = 500
 
 // Category defines the structure for a category.
 type Category struct {
-	ID        string `json:"id" firestore:"id"`
-	Name      string `json:"name" firestore:"name"`
-	Image	    string `json:"image" firestore:"image"`
-	IsEnabled bool   `json:"is_enabled" firestore:"is_enabled"`
+	ID        string     `json:"id" firestore:"id"`
+	Name      string     `json:"name" firestore:"name"`
+	ParentID  string     `json:"parent_id" firestore:"parent_id"`
+	Image     string     `json:"image" firestore:"image"`
+	SortOrder int        `json:"sort_order" firestore:"sort_order"`
+	IsEnabled bool       `json:"is_enabled" firestore:"is_enabled"`
+	CreatedAt time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" firestore:"updated_at"`
+	CreatedBy string     `json:"created_by" firestore:"created_by"`
+	UpdatedBy string     `json:"updated_by" firestore:"updated_by"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" firestore:"deleted_at"`
+	DeletedBy string     `json:"deleted_by,omitempty" firestore:"deleted_by,omitempty"`
+	Version   string     `json:"version,omitempty" firestore:"-"`
 }
 
+// ClientCategory is a node of the category tree returned to the storefront.
+// ProductCount includes the enabled products of every subcategory.
 type ClientCategory struct {
-	ID     string `json:"id" firestore:"id"`
-	Name   string `json:"name" firestore:"name"`
-	Image  string `json:"image" firestore:"image"`
+	ID           string           `json:"id" firestore:"id"`
+	ParentID     string           `json:"parent_id,omitempty" firestore:"parent_id"`
+	Name         string           `json:"name" firestore:"name"`
+	Image        string           `json:"image" firestore:"image"`
+	SortOrder    int              `json:"sort_order" firestore:"sort_order"`
+	ProductCount int              `json:"product_count" firestore:"-"`
+	Children     []ClientCategory `json:"children,omitempty" firestore:"-"`
+}
+
+// Breadcrumb is one step on the path from the root of the tree to a category.
+type Breadcrumb struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CategoryDetail is a storefront category together with its breadcrumb trail, root first.
+type CategoryDetail struct {
+	Category   ClientCategory `json:"category"`
+	Breadcrumb []Breadcrumb   `json:"breadcrumb"`
 }
 
 // Service provides category operations.
@@ -22,9 +65,18 @@ type Service interface {
 	AdminCreateCategory(ctx context.Context, category Category) (Category, error)
 	AdminGetCategories(ctx context.Context, page, pageSize int, search string) ([]Category, int, error)
 	AdminGetCategory(ctx context.Context, id string) (Category, error)
-	AdminUpdateCategory(ctx context.Context, id string, category Category) (Category, error)
-	AdminDeleteCategory(ctx context.Context, id string) error
+	AdminUpdateCategory(ctx context.Context, id, version string, category Category) (Category, error)
+	AdminPatchCategory(ctx context.Context, id, version string, fields map[string]interface{}) (Category, error)
+	AdminDeleteCategory(ctx context.Context, id, reassignTo string) error
+	AdminReorderCategories(ctx context.Context, ids []string) error
+	AdminGetDeletedCategories(ctx context.Context, page, pageSize int) ([]Category, int, error)
+	AdminRestoreCategory(ctx context.Context, id string) (Category, error)
+	PurgeDeletedCategories(ctx context.Context, before time.Time) (int, error)
 
 	// Client operations
 	GetCategories(ctx context.Context) ([]ClientCategory, error)
+	GetCategory(ctx context.Context, id string) (CategoryDetail, error)
+	DescendantIDs(ctx context.Context, id string) ([]string, error)
+	CategoryName(ctx context.Context, id string) (string, bool, error)
+	VisibleCategoryIDs(ctx context.Context) (map[string]bool, error)
 }
@@ -2,36 +2,57 @@ package category
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
 )
 
+// maxConcurrentCounts is how many product counts of a category tree run at the same time.
+const maxConcurrentCounts = 8
 
 // FirestoreService is a Firestore implementation of the category service.
 type FirestoreService struct {
-	client     *firestore.Client
-	collection string
+	client            *firestore.Client
+	collection        string
+	productCollection string
 }
 
 // NewFirestoreService creates a new Firestore-backed category service.
 func NewFirestoreService(client *firestore.Client) *FirestoreService {
 	return &FirestoreService{
-		client:     client,
-		collection: "category",
+		client:            client,
+		collection:        "category",
+		productCollection: "products",
 	}
 }
 
 func (s *FirestoreService) AdminCreateCategory(ctx context.Context, category Category) (Category, error) {
+	if err := s.validateParent(ctx, "", category.ParentID); err != nil {
+		return Category{}, err
+	}
+
 	ref := s.client.Collection(s.collection).NewDoc()
 	category.ID = ref.ID
+	now, actor := time.Now(), auth.Actor(ctx)
+	category.CreatedAt, category.UpdatedAt = now, now
+	category.CreatedBy, category.UpdatedBy = actor, actor
 
-	_, err := ref.Set(ctx, category)
+	wr, err := ref.Set(ctx, category)
 	if err != nil {
 		log.Printf("Failed to create category: %v", err)
 		return Category{}, err
 	}
+	category.Version = etag.Version(wr.UpdateTime)
 	return category, nil
 }
 
@@ -55,9 +76,18 @@ func (s *FirestoreService) AdminGetCategories(ctx context.Context, page, pageSiz
 		}
 		var category Category
 		doc.DataTo(&category)
+		if category.DeletedAt != nil {
+			continue
+		}
+		category.Version = etag.Version(doc.UpdateTime)
 		categories = append(categories, category)
 	}
 
+	// Sorted in memory so categories without a sort_order field are still listed.
+	sort.SliceStable(categories, func(i, j int) bool {
+		return categories[i].SortOrder < categories[j].SortOrder
+	})
+
 	totalCount := len(categories)
 	start := (page - 1) * pageSize
 	end := start + pageSize
@@ -83,26 +113,401 @@ func (s *FirestoreService) AdminGetCategory(ctx context.Context, id string) (Cat
 	if err := doc.DataTo(&category); err != nil {
 		return Category{}, err
 	}
+	category.Version = etag.Version(doc.UpdateTime)
 	return category, nil
 }
 
-func (s *FirestoreService) AdminUpdateCategory(ctx context.Context, id string, category Category) (Category, error) {
+func (s *FirestoreService) AdminUpdateCategory(ctx context.Context, id, version string, category Category) (Category, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Category{}, err
+	}
+	if err := s.validateParent(ctx, id, category.ParentID); err != nil {
+		return Category{}, err
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
 	category.ID = id
-	_, err := s.client.Collection(s.collection).Doc(id).Set(ctx, category)
+
+	// PUT replaces the whole document, but only if it exists and has not changed since it was read.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+
+		// Creation stamps always come from the stored document, never from the request.
+		var existing Category
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrCategoryNotFound
+		}
+		category.CreatedAt, category.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		category.DeletedAt, category.DeletedBy = nil, ""
+		category.UpdatedAt, category.UpdatedBy = time.Now(), auth.Actor(ctx)
+		return tx.Set(ref, category)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCategoryNotFound) {
+		return Category{}, ErrCategoryNotFound
+	}
 	if err != nil {
+		log.Printf("Failed to update category: %v", err)
 		return Category{}, err
 	}
-	return category, nil
+	// Every save copies the name, so saving again finishes a rename that failed halfway.
+	if err := s.renameProducts(ctx, id, category.Name); err != nil {
+		return Category{}, err
+	}
+	return s.AdminGetCategory(ctx, id)
+}
+
+func (s *FirestoreService) AdminPatchCategory(ctx context.Context, id, version string, fields map[string]interface{}) (Category, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Category{}, err
+	}
+	if parentID, ok := fields["parent_id"].(string); ok {
+		if err := s.validateParent(ctx, id, parentID); err != nil {
+			return Category{}, err
+		}
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
+
+	updates := []firestore.Update{
+		{Path: "updated_at", Value: time.Now()},
+		{Path: "updated_by", Value: auth.Actor(ctx)},
+	}
+	for key, value := range fields {
+		updates = append(updates, firestore.Update{Path: key, Value: value})
+	}
+
+	// Update only touches the given paths; like PUT it needs the document to be unchanged and not in the trash.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+		var existing Category
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrCategoryNotFound
+		}
+		return tx.Update(ref, updates)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCategoryNotFound) {
+		return Category{}, ErrCategoryNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to patch category: %v", err)
+		return Category{}, err
+	}
+	if name, ok := fields["name"].(string); ok {
+		if err := s.renameProducts(ctx, id, name); err != nil {
+			return Category{}, err
+		}
+	}
+
+	return s.AdminGetCategory(ctx, id)
+}
+
+// AdminDeleteCategory moves the category to the trash; PurgeDeletedCategories removes it for good.
+// Products filed under the category are moved to reassignTo first; without it the delete is refused.
+// The category is only trashed once no product is left in it, so a delete that fails while moving
+// products can simply be sent again.
+func (s *FirestoreService) AdminDeleteCategory(ctx context.Context, id, reassignTo string) error {
+	// Refuse to orphan subcategories; they have to be moved or deleted first.
+	children, err := s.client.Collection(s.collection).Where("parent_id", "==", id).Where("deleted_at", "==", nil).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to check subcategories: %v", err)
+		return err
+	}
+	if len(children) > 0 {
+		return ErrCategoryHasChildren
+	}
+
+	// Products in the trash count too, otherwise restoring them would bring back orphans.
+	products := s.client.Collection(s.productCollection).Where("category_id", "==", id).Limit(1)
+	remaining, err := products.Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to check category products: %v", err)
+		return err
+	}
+	if len(remaining) > 0 {
+		if reassignTo == "" {
+			return ErrCategoryHasProducts
+		}
+		if reassignTo == id {
+			return ErrReassignTarget
+		}
+		name, found, err := s.CategoryName(ctx, reassignTo)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrReassignTarget
+		}
+		if err := s.updateProducts(ctx, id, []firestore.Update{
+			{Path: "category_id", Value: reassignTo},
+			{Path: "category", Value: name},
+		}, nil); err != nil {
+			return err
+		}
+	}
+
+	ref := s.client.Collection(s.collection).Doc(id)
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var category Category
+		if err := doc.DataTo(&category); err != nil {
+			return err
+		}
+		if category.DeletedAt != nil {
+			return ErrCategoryNotFound
+		}
+		// A product filed here while the others were being moved keeps the category alive.
+		remaining, err := tx.Documents(products).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(remaining) > 0 {
+			return ErrCategoryHasProducts
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: time.Now()},
+			{Path: "deleted_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if errors.Is(err, ErrCategoryHasProducts) {
+		return err
+	}
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCategoryNotFound) {
+		return ErrCategoryNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to delete category: %v", err)
+		return err
+	}
+	return nil
+}
+
+// AdminReorderCategories sets sort_order of the given categories to their position in ids.
+func (s *FirestoreService) AdminReorderCategories(ctx context.Context, ids []string) error {
+	refs := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		refs[i] = s.client.Collection(s.collection).Doc(id)
+	}
+
+	now, actor := time.Now(), auth.Actor(ctx)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.GetAll(refs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if !doc.Exists() {
+				return ErrCategoryNotFound
+			}
+			var category Category
+			if err := doc.DataTo(&category); err != nil {
+				return err
+			}
+			if category.DeletedAt != nil {
+				return ErrCategoryNotFound
+			}
+		}
+		for i, ref := range refs {
+			err := tx.Update(ref, []firestore.Update{
+				{Path: "sort_order", Value: i},
+				{Path: "updated_at", Value: now},
+				{Path: "updated_by", Value: actor},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrCategoryNotFound) {
+		return ErrCategoryNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to reorder categories: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *FirestoreService) AdminGetDeletedCategories(ctx context.Context, page, pageSize int) ([]Category, int, error) {
+	var categories []Category
+	query := s.client.Collection(s.collection).Where("deleted_at", "!=", nil).OrderBy("deleted_at", firestore.Desc)
+
+	iter := query.Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted categories: %v", err)
+			return nil, 0, err
+		}
+		var category Category
+		doc.DataTo(&category)
+		category.Version = etag.Version(doc.UpdateTime)
+		categories = append(categories, category)
+	}
+
+	totalCount := len(categories)
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Category{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	return categories[start:end], totalCount, nil
 }
 
-func (s *FirestoreService) AdminDeleteCategory(ctx context.Context, id string) error {
-	_, err := s.client.Collection(s.collection).Doc(id).Delete(ctx)
-	return err
+func (s *FirestoreService) AdminRestoreCategory(ctx context.Context, id string) (Category, error) {
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var category Category
+		if err := doc.DataTo(&category); err != nil {
+			return err
+		}
+		if category.DeletedAt == nil {
+			return ErrCategoryNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: nil},
+			{Path: "deleted_by", Value: firestore.Delete},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCategoryNotFound) {
+		return Category{}, ErrCategoryNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to restore category: %v", err)
+		return Category{}, err
+	}
+	return s.AdminGetCategory(ctx, id)
+}
+
+// PurgeDeletedCategories permanently removes categories that were moved to the trash before the given time.
+func (s *FirestoreService) PurgeDeletedCategories(ctx context.Context, before time.Time) (int, error) {
+	iter := s.client.Collection(s.collection).Where("deleted_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted categories: %v", err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge category %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
 }
 
 func (s *FirestoreService) GetCategories(ctx context.Context) ([]ClientCategory, error) {
+	categories, err := s.enabledCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(categories))
+	for i, category := range categories {
+		ids[i] = category.ID
+	}
+	counts, err := s.countAllProducts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := buildTree(categories)
+	rollUpCounts(tree, counts)
+	return tree, nil
+}
+
+// GetCategory returns a visible category with its subcategories and breadcrumb trail.
+// A category below a disabled parent is hidden from the storefront and reported as not found.
+func (s *FirestoreService) GetCategory(ctx context.Context, id string) (CategoryDetail, error) {
+	categories, err := s.enabledCategories(ctx)
+	if err != nil {
+		return CategoryDetail{}, err
+	}
+
+	path := findPath(buildTree(categories), id)
+	if path == nil {
+		return CategoryDetail{}, ErrCategoryNotFound
+	}
+	node := path[len(path)-1]
+
+	counts, err := s.countAllProducts(ctx, subtreeIDs(node))
+	if err != nil {
+		return CategoryDetail{}, err
+	}
+	nodes := []ClientCategory{node}
+	rollUpCounts(nodes, counts)
+
+	breadcrumb := make([]Breadcrumb, len(path))
+	for i, c := range path {
+		breadcrumb[i] = Breadcrumb{ID: c.ID, Name: c.Name}
+	}
+	return CategoryDetail{Category: nodes[0], Breadcrumb: breadcrumb}, nil
+}
+
+// VisibleCategoryIDs returns the categories the storefront shows: enabled, not in the trash,
+// and under parents that are shown as well.
+func (s *FirestoreService) VisibleCategoryIDs(ctx context.Context) (map[string]bool, error) {
+	categories, err := s.enabledCategories(ctx)
+	if err != nil {
+		log.Printf("Failed to get categories: %v", err)
+		return nil, err
+	}
+	visible := make(map[string]bool, len(categories))
+	for _, root := range buildTree(categories) {
+		for _, id := range subtreeIDs(root) {
+			visible[id] = true
+		}
+	}
+	return visible, nil
+}
+
+// enabledCategories loads the categories shown on the storefront.
+func (s *FirestoreService) enabledCategories(ctx context.Context) ([]ClientCategory, error) {
 	var categories []ClientCategory
-	iter := s.client.Collection(s.collection).Where("is_enabled", "==", true).Documents(ctx)
+	iter := s.client.Collection(s.collection).Where("is_enabled", "==", true).Where("deleted_at", "==", nil).Documents(ctx)
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -120,3 +525,160 @@ func (s *FirestoreService) GetCategories(ctx context.Context) ([]ClientCategory,
 	}
 	return categories, nil
 }
+
+// countAllProducts counts the enabled products filed directly under each of the categories. Each
+// count is an aggregation query, which costs one read per 1000 products instead of one per product,
+// and a few run at a time so a large tree does not wait on them one by one.
+func (s *FirestoreService) countAllProducts(ctx context.Context, ids []string) (map[string]int, error) {
+	counts := make([]int, len(ids))
+	errs := make([]error, len(ids))
+	slots := make(chan struct{}, maxConcurrentCounts)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			counts[i], errs[i] = s.countProducts(ctx, id)
+		}()
+	}
+	wg.Wait()
+
+	result := make(map[string]int, len(ids))
+	for i, id := range ids {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		result[id] = counts[i]
+	}
+	return result, nil
+}
+
+// countProducts counts the enabled products filed directly under the category with an aggregation query.
+func (s *FirestoreService) countProducts(ctx context.Context, categoryID string) (int, error) {
+	query := s.client.Collection(s.productCollection).
+		Where("category_id", "==", categoryID).
+		Where("is_enabled", "==", true).
+		Where("deleted_at", "==", nil)
+	result, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		log.Printf("Failed to count products of category %s: %v", categoryID, err)
+		return 0, err
+	}
+	value, ok := result["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, nil
+	}
+	return int(value.GetIntegerValue()), nil
+}
+
+// DescendantIDs returns id together with the IDs of every category nested below it.
+func (s *FirestoreService) DescendantIDs(ctx context.Context, id string) ([]string, error) {
+	categories, err := s.allCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return descendantIDs(categories, id), nil
+}
+
+// CategoryName returns the name of the category, reporting found as false when it does not exist or is in the trash.
+func (s *FirestoreService) CategoryName(ctx context.Context, id string) (string, bool, error) {
+	category, err := s.AdminGetCategory(ctx, id)
+	if status.Code(err) == codes.NotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Printf("Failed to get category: %v", err)
+		return "", false, err
+	}
+	if category.DeletedAt != nil {
+		return "", false, nil
+	}
+	return category.Name, true, nil
+}
+
+// renameProducts copies the category name onto the products that store it denormalized.
+// Products that already have it are skipped.
+func (s *FirestoreService) renameProducts(ctx context.Context, categoryID, name string) error {
+	return s.updateProducts(ctx, categoryID, []firestore.Update{{Path: "category", Value: name}},
+		func(doc *firestore.DocumentSnapshot) bool { return doc.Data()["category"] == name })
+}
+
+// updateProducts applies the updates to every product filed under the category, trashed ones
+// included, except those upToDate reports as already done. A transaction would cap the category
+// at 500 products, so the writes go through a BulkWriter after the category itself is saved, and
+// a failure leaves a state that the same call can finish. Only the copied category fields change;
+// the audit stamps are left alone, since nobody edited the products themselves.
+func (s *FirestoreService) updateProducts(ctx context.Context, categoryID string, updates []firestore.Update, upToDate func(*firestore.DocumentSnapshot) bool) error {
+	iter := s.client.Collection(s.productCollection).Where("category_id", "==", categoryID).Select("category").Documents(ctx)
+	defer iter.Stop()
+
+	writer := s.client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			writer.End()
+			log.Printf("Failed to get category products: %v", err)
+			return err
+		}
+		if upToDate != nil && upToDate(doc) {
+			continue
+		}
+		job, err := writer.Update(doc.Ref, updates)
+		if err != nil {
+			writer.End()
+			log.Printf("Failed to queue update of product %s: %v", doc.Ref.ID, err)
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	writer.End()
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			log.Printf("Failed to update category products: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// allCategories loads every category that is not in the trash.
+func (s *FirestoreService) allCategories(ctx context.Context) ([]Category, error) {
+	var categories []Category
+	iter := s.client.Collection(s.collection).Where("deleted_at", "==", nil).Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get categories: %v", err)
+			return nil, err
+		}
+
+		var category Category
+		if err := doc.DataTo(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+// validateParent checks that moving category id under parentID keeps the tree valid.
+func (s *FirestoreService) validateParent(ctx context.Context, id, parentID string) error {
+	if parentID == "" && id == "" {
+		return nil
+	}
+	categories, err := s.allCategories(ctx)
+	if err != nil {
+		return err
+	}
+	return validateParent(categories, id, parentID)
+}
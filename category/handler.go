@@ -2,20 +2,47 @@ package category
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
 	"suto-e-shop-api/pkg/pagination"
+	"suto-e-shop-api/pkg/patch"
+	"suto-e-shop-api/product"
 )
 
-// Handler holds the category service.
+// categoryPatchRules lists the fields a PATCH request may change.
+var categoryPatchRules = map[string]patch.Rule{
+	"name":       patch.RequiredString(),
+	"parent_id":  patch.String(),
+	"image":      patch.String(),
+	"sort_order": patch.Int(0, math.MaxInt32),
+	"is_enabled": patch.Bool(),
+}
+
+// isTreeError reports whether err is a rejected change to the category tree.
+func isTreeError(err error) bool {
+	return errors.Is(err, ErrParentNotFound) || errors.Is(err, ErrCategoryCycle) || errors.Is(err, ErrCategoryTooDeep)
+}
+
+// Handler holds the category service and the product service used by the category page.
 type Handler struct {
-	service Service
+	service  Service
+	products product.Service
 }
 
 // NewHandler creates a new category handler.
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service Service, products product.Service) *Handler {
+	return &Handler{service: service, products: products}
+}
+
+// CategoryPage is the storefront landing page of a category.
+type CategoryPage struct {
+	CategoryDetail
+	Products []product.ProductSimple `json:"products"`
 }
 
 // RegisterAdminRoutes registers the admin category routes to the router.
@@ -24,14 +51,19 @@ func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
 
 	adminRouter.HandleFunc("", h.AdminCreateCategory).Methods("POST")
 	adminRouter.HandleFunc("", h.AdminGetCategories).Methods("GET")
+	adminRouter.HandleFunc("/trash", h.AdminGetDeletedCategories).Methods("GET")
+	adminRouter.HandleFunc("/order", h.AdminReorderCategories).Methods("PUT")
 	adminRouter.HandleFunc("/{id}", h.AdminGetCategory).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.AdminUpdateCategory).Methods("PUT")
+	adminRouter.HandleFunc("/{id}", h.AdminPatchCategory).Methods("PATCH")
 	adminRouter.HandleFunc("/{id}", h.AdminDeleteCategory).Methods("DELETE")
+	adminRouter.HandleFunc("/{id}/restore", h.AdminRestoreCategory).Methods("POST")
 }
 
 // RegisterClientRoutes registers the client category routes to the router.
 func (h *Handler) RegisterClientRoutes(router *mux.Router) {
 	router.HandleFunc("/categories", h.GetCategories).Methods("GET")
+	router.HandleFunc("/categories/{id}", h.GetCategory).Methods("GET")
 }
 
 func (h *Handler) AdminCreateCategory(w http.ResponseWriter, r *http.Request) {
@@ -42,11 +74,16 @@ func (h *Handler) AdminCreateCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	createdCategory, err := h.service.AdminCreateCategory(r.Context(), category)
+	if isTreeError(err) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	etag.SetHeader(w, createdCategory.Version)
 	RespondWithJSON(w, http.StatusCreated, Response{Data: createdCategory, Message: "success", Code: 0})
 }
 
@@ -80,6 +117,7 @@ func (h *Handler) AdminGetCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, category.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: category, Message: "success", Code: 0})
 }
 
@@ -87,18 +125,81 @@ func (h *Handler) AdminUpdateCategory(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
 	var category Category
 	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	updatedCategory, err := h.service.AdminUpdateCategory(r.Context(), id, category)
+	updatedCategory, err := h.service.AdminUpdateCategory(r.Context(), id, version, category)
+	if isTreeError(err) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrCategoryNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
 	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedCategory.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedCategory, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminPatchCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	fields, err := patch.Validate(data, categoryPatchRules)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updatedCategory, err := h.service.AdminPatchCategory(r.Context(), id, version, fields)
+	if isTreeError(err) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrCategoryNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Category not found")
 		return
 	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	etag.SetHeader(w, updatedCategory.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: updatedCategory, Message: "success", Code: 0})
 }
 
@@ -106,14 +207,105 @@ func (h *Handler) AdminDeleteCategory(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := h.service.AdminDeleteCategory(r.Context(), id); err != nil {
+	reassignTo := r.URL.Query().Get("reassign_to")
+
+	err := h.service.AdminDeleteCategory(r.Context(), id, reassignTo)
+	if errors.Is(err, ErrCategoryNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if errors.Is(err, ErrReassignTarget) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrCategoryHasChildren) || errors.Is(err, ErrCategoryHasProducts) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
+}
+
+// AdminReorderCategories takes {"ids": [...]} and numbers the categories in that order.
+func (h *Handler) AdminReorderCategories(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(body.IDs) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	if len(body.IDs) > MaxReorderIds {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("too many category ids, at most %d allowed", MaxReorderIds))
+		return
+	}
+	seen := make(map[string]bool, len(body.IDs))
+	for _, id := range body.IDs {
+		if id == "" || seen[id] {
+			RespondWithError(w, http.StatusBadRequest, "ids must be unique and non-empty")
+			return
+		}
+		seen[id] = true
+	}
+
+	err := h.service.AdminReorderCategories(r.Context(), body.IDs)
+	if errors.Is(err, ErrCategoryNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Category not found")
 		return
 	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
 }
 
+func (h *Handler) AdminGetDeletedCategories(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := pagination.GetPaginationParams(r)
+
+	categories, totalCount, err := h.service.AdminGetDeletedCategories(r.Context(), page, pageSize)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       categories,
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
+}
+
+func (h *Handler) AdminRestoreCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	category, err := h.service.AdminRestoreCategory(r.Context(), id)
+	if errors.Is(err, ErrCategoryNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Category not found in trash")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, category.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: category, Message: "success", Code: 0})
+}
+
 func (h *Handler) GetCategories(w http.ResponseWriter, r *http.Request) {
 	categories, err := h.service.GetCategories(r.Context())
 	if err != nil {
@@ -123,3 +315,44 @@ func (h *Handler) GetCategories(w http.ResponseWriter, r *http.Request) {
 
 	RespondWithJSON(w, http.StatusOK, Response{Data: categories, Message: "success", Code: 0})
 }
+
+// GetCategory returns the category with its breadcrumb and a page of the enabled products in it and its subcategories.
+// It accepts the same page, pageSize and sort parameters as the product listing.
+func (h *Handler) GetCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	page, pageSize := pagination.GetPaginationParams(r)
+	sortBy := r.URL.Query().Get("sort")
+
+	detail, err := h.service.GetCategory(r.Context(), id)
+	if errors.Is(err, ErrCategoryNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	products, totalCount, err := h.products.GetProducts(r.Context(), page, pageSize, "", subtreeIDs(detail.Category), sortBy, true)
+	if errors.Is(err, product.ErrInvalidSort) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if products == nil {
+		products = []product.ProductSimple{}
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       CategoryPage{CategoryDetail: detail, Products: products},
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
+}
@@ -0,0 +1,170 @@
+package category
+
+import (
+	"errors"
+	"sort"
+)
+
+// MaxDepth is how many levels the category tree may have, e.g. Tea > Oolong > High Mountain.
+const MaxDepth = 3
+
+var (
+	// ErrParentNotFound is returned when parent_id does not point at an existing category.
+	ErrParentNotFound = errors.New("parent category not found")
+	// ErrCategoryCycle is returned when a category would become its own ancestor.
+	ErrCategoryCycle = errors.New("a category cannot be moved under itself or one of its descendants")
+	// ErrCategoryTooDeep is returned when a move would make the tree deeper than MaxDepth.
+	ErrCategoryTooDeep = errors.New("category tree cannot be deeper than 3 levels")
+	// ErrCategoryHasChildren is returned when deleting a category that still has subcategories.
+	ErrCategoryHasChildren = errors.New("category still has subcategories")
+)
+
+// validateParent checks that the category id may be placed under parentID.
+// id is empty for a category that is being created.
+func validateParent(categories []Category, id, parentID string) error {
+	byID := make(map[string]Category, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+
+	height := 1
+	if id != "" {
+		height = subtreeHeight(categories, id)
+	}
+	if parentID == "" {
+		if height > MaxDepth {
+			return ErrCategoryTooDeep
+		}
+		return nil
+	}
+	if parentID == id {
+		return ErrCategoryCycle
+	}
+
+	parent, ok := byID[parentID]
+	if !ok {
+		return ErrParentNotFound
+	}
+
+	// Walk up from the new parent; meeting id on the way means the move would create a cycle.
+	depth := 1
+	for ancestor := parent; ancestor.ParentID != ""; depth++ {
+		if ancestor.ParentID == id {
+			return ErrCategoryCycle
+		}
+		next, ok := byID[ancestor.ParentID]
+		if !ok || depth > MaxDepth {
+			break
+		}
+		ancestor = next
+	}
+
+	if depth+height > MaxDepth {
+		return ErrCategoryTooDeep
+	}
+	return nil
+}
+
+// subtreeHeight returns the number of levels from id down to its deepest descendant, id included.
+// It stops counting once the tree is already too deep, which also guards against corrupt cycles.
+func subtreeHeight(categories []Category, id string) int {
+	height := 1
+	level := []string{id}
+	for len(level) > 0 && height <= MaxDepth {
+		var next []string
+		for _, c := range categories {
+			for _, parentID := range level {
+				if c.ParentID == parentID {
+					next = append(next, c.ID)
+				}
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		level = next
+		height++
+	}
+	return height
+}
+
+// descendantIDs returns id followed by the IDs of all categories below it.
+func descendantIDs(categories []Category, id string) []string {
+	seen := map[string]bool{id: true}
+	ids := []string{id}
+	for i := 0; i < len(ids); i++ {
+		for _, c := range categories {
+			if c.ParentID == ids[i] && !seen[c.ID] {
+				seen[c.ID] = true
+				ids = append(ids, c.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// buildTree nests the categories under their parents and returns the root level, each level in sort order.
+// Categories whose parent is not in the list are left out, so hiding a parent hides its subtree.
+func buildTree(categories []ClientCategory) []ClientCategory {
+	children := make(map[string][]ClientCategory)
+	for _, c := range categories {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+
+	var attach func(parentID string, depth int) []ClientCategory
+	attach = func(parentID string, depth int) []ClientCategory {
+		nodes := children[parentID]
+		sortCategories(nodes)
+		if depth >= MaxDepth {
+			return nodes
+		}
+		for i := range nodes {
+			nodes[i].Children = attach(nodes[i].ID, depth+1)
+		}
+		return nodes
+	}
+	return attach("", 1)
+}
+
+// findPath returns the nodes from the root level down to the category id, or nil if it is not in the tree.
+func findPath(nodes []ClientCategory, id string) []ClientCategory {
+	for _, node := range nodes {
+		if node.ID == id {
+			return []ClientCategory{node}
+		}
+		if path := findPath(node.Children, id); path != nil {
+			return append([]ClientCategory{node}, path...)
+		}
+	}
+	return nil
+}
+
+// subtreeIDs returns the IDs of node and every category nested below it.
+func subtreeIDs(node ClientCategory) []string {
+	ids := []string{node.ID}
+	for _, child := range node.Children {
+		ids = append(ids, subtreeIDs(child)...)
+	}
+	return ids
+}
+
+// sortCategories orders one level of the tree by sort_order, falling back to the name.
+func sortCategories(nodes []ClientCategory) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].SortOrder != nodes[j].SortOrder {
+			return nodes[i].SortOrder < nodes[j].SortOrder
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+}
+
+// rollUpCounts adds each node's own product count from counts to the totals of its subtree
+// and returns the total of the whole level.
+func rollUpCounts(nodes []ClientCategory, counts map[string]int) int {
+	total := 0
+	for i := range nodes {
+		nodes[i].ProductCount = counts[nodes[i].ID] + rollUpCounts(nodes[i].Children, counts)
+		total += nodes[i].ProductCount
+	}
+	return total
+}
@@ -0,0 +1,140 @@
+package category
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testCategories is Tea > Oolong > High Mountain, plus Coffee on its own.
+var testCategories = []Category{
+	{ID: "tea"},
+	{ID: "oolong", ParentID: "tea"},
+	{ID: "mountain", ParentID: "oolong"},
+	{ID: "green", ParentID: "tea"},
+	{ID: "coffee"},
+}
+
+func TestValidateParent(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		parentID string
+		want     error
+	}{
+		{"new root", "", "", nil},
+		{"new child", "", "tea", nil},
+		{"new grandchild", "", "oolong", nil},
+		{"new fourth level", "", "mountain", ErrCategoryTooDeep},
+		{"missing parent", "", "juice", ErrParentNotFound},
+		{"under itself", "oolong", "oolong", ErrCategoryCycle},
+		{"under its descendant", "tea", "mountain", ErrCategoryCycle},
+		{"move leaf under sibling", "mountain", "green", nil},
+		{"move subtree too deep", "oolong", "green", ErrCategoryTooDeep},
+		{"move subtree to root", "oolong", "", nil},
+		{"move subtree under other root", "oolong", "coffee", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateParent(testCategories, tt.id, tt.parentID); !errors.Is(err, tt.want) {
+				t.Errorf("validateParent() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtreeHeight(t *testing.T) {
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"tea", 3},
+		{"oolong", 2},
+		{"mountain", 1},
+		{"coffee", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := subtreeHeight(testCategories, tt.id); got != tt.want {
+				t.Errorf("subtreeHeight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescendantIDs(t *testing.T) {
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"tea", []string{"tea", "oolong", "green", "mountain"}},
+		{"oolong", []string{"oolong", "mountain"}},
+		{"coffee", []string{"coffee"}},
+		{"juice", []string{"juice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := descendantIDs(testCategories, tt.id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("descendantIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	tree := buildTree([]ClientCategory{
+		{ID: "green", ParentID: "tea", Name: "Green", SortOrder: 2},
+		{ID: "coffee", Name: "Coffee", SortOrder: 1},
+		{ID: "oolong", ParentID: "tea", Name: "Oolong", SortOrder: 1},
+		{ID: "tea", Name: "Tea", SortOrder: 1},
+		{ID: "mountain", ParentID: "oolong", Name: "High Mountain"},
+		{ID: "orphan", ParentID: "hidden", Name: "Orphan"},
+	})
+
+	var roots []string
+	for _, node := range tree {
+		roots = append(roots, node.ID)
+	}
+	if want := []string{"coffee", "tea"}; !reflect.DeepEqual(roots, want) {
+		t.Errorf("roots = %v, want %v", roots, want)
+	}
+
+	var path []string
+	for _, node := range findPath(tree, "mountain") {
+		path = append(path, node.ID)
+	}
+	if want := []string{"tea", "oolong", "mountain"}; !reflect.DeepEqual(path, want) {
+		t.Errorf("findPath() = %v, want %v", path, want)
+	}
+
+	if got, want := subtreeIDs(tree[1]), []string{"tea", "oolong", "mountain", "green"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subtreeIDs() = %v, want %v", got, want)
+	}
+	if got := findPath(tree, "orphan"); got != nil {
+		t.Errorf("findPath() of a category under a hidden parent = %v, want nil", got)
+	}
+}
+
+func TestRollUpCounts(t *testing.T) {
+	tree := []ClientCategory{
+		{ID: "tea", Children: []ClientCategory{
+			{ID: "oolong", Children: []ClientCategory{{ID: "mountain"}}},
+			{ID: "green"},
+		}},
+		{ID: "coffee"},
+	}
+	total := rollUpCounts(tree, map[string]int{"tea": 1, "oolong": 2, "mountain": 3, "coffee": 4})
+
+	if total != 10 {
+		t.Errorf("total = %d, want 10", total)
+	}
+	if got := tree[0].ProductCount; got != 6 {
+		t.Errorf("tea = %d, want 6", got)
+	}
+	if got := tree[0].Children[0].ProductCount; got != 5 {
+		t.Errorf("oolong = %d, want 5", got)
+	}
+	if got := tree[0].Children[1].ProductCount; got != 0 {
+		t.Errorf("green = %d, want 0", got)
+	}
+}
@@ -0,0 +1,106 @@
+// Command migrate runs one-off Firestore data migrations.
+//
+// Usage:
+//
+//	go run ./cmd/migrate <migration>
+//
+// It reads GOOGLE_CLOUD_PROJECT and FIRESTORE_DATABASE_ID like the API server.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"suto-e-shop-api/advertise"
+	"suto-e-shop-api/order"
+)
+
+// migration updates existing documents and reports how many were changed.
+type migration func(ctx context.Context, client *firestore.Client) (int, error)
+
+var migrations = map[string]migration{
+	// Converts order created_at/paid_at/picked_at/disabled_at from unix-second strings to timestamps.
+	"order-timestamps": func(ctx context.Context, client *firestore.Client) (int, error) {
+		return order.NewFirestoreService(client, nil, nil).MigrateTimestamps(ctx)
+	},
+	// Adds deleted_at: null to catalog documents so "not deleted" queries can match them.
+	"soft-delete-fields": func(ctx context.Context, client *firestore.Client) (int, error) {
+		total := 0
+		for _, collection := range []string{"products", "category", "coupons", "advertises"} {
+			count, err := backfillField(ctx, client, collection, "deleted_at", nil)
+			total += count
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	},
+	// Converts the free-form advertise link into a typed target.
+	"advertise-targets": func(ctx context.Context, client *firestore.Client) (int, error) {
+		return advertise.NewFirestoreService(client).MigrateLinkTargets(ctx)
+	},
+}
+
+// backfillField sets field to value on every document in the collection that does not have it yet.
+func backfillField(ctx context.Context, client *firestore.Client, collection, field string, value interface{}) (int, error) {
+	iter := client.Collection(collection).Documents(ctx)
+	defer iter.Stop()
+
+	count := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if _, ok := doc.Data()[field]; ok {
+			continue
+		}
+		if _, err := doc.Ref.Update(ctx, []firestore.Update{{Path: field, Value: value}}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func main() {
+	if len(os.Args) != 2 || migrations[os.Args[1]] == nil {
+		var names []string
+		for name := range migrations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("Usage: migrate <migration>\nAvailable migrations: %v", names)
+	}
+	name := os.Args[1]
+
+	ctx := context.Background()
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		log.Fatal("GOOGLE_CLOUD_PROJECT environment variable must be set.")
+	}
+
+	databaseID := os.Getenv("FIRESTORE_DATABASE_ID")
+	if databaseID == "" {
+		log.Fatal("FIRESTORE_DATABASE_ID environment variable must be set.")
+	}
+
+	client, err := firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+	if err != nil {
+		log.Fatalf("Failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
+
+	count, err := migrations[name](ctx, client)
+	if err != nil {
+		log.Fatalf("Migration %s failed after %d documents: %v", name, count, err)
+	}
+	log.Printf("Migration %s updated %d documents", name, count)
+}
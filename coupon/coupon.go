@@ -2,17 +2,29 @@ package coupon
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+// ErrCouponNotFound is returned when the requested coupon does not exist.
+var ErrCouponNotFound = errors.New("coupon not found")
+
 // Coupon defines the coupon data structure.
 type Coupon struct {
-	ID        string `json:"id" firestore:"id"`
-	Name      string `json:"name" firestore:"name"`
-	Code      string `json:"code" firestore:"code"`
-	Percent   int    `json:"percent" firestore:"percent"`
-	StartTime int64  `json:"start_time" firestore:"start_time"`
-	EndTime   int64  `json:"end_time" firestore:"end_time"`
-	IsEnabled bool   `json:"is_enabled" firestore:"is_enabled"`
+	ID        string     `json:"id" firestore:"id"`
+	Name      string     `json:"name" firestore:"name"`
+	Code      string     `json:"code" firestore:"code"`
+	Percent   int        `json:"percent" firestore:"percent"`
+	StartTime int64      `json:"start_time" firestore:"start_time"`
+	EndTime   int64      `json:"end_time" firestore:"end_time"`
+	IsEnabled bool       `json:"is_enabled" firestore:"is_enabled"`
+	CreatedAt time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" firestore:"updated_at"`
+	CreatedBy string     `json:"created_by" firestore:"created_by"`
+	UpdatedBy string     `json:"updated_by" firestore:"updated_by"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" firestore:"deleted_at"`
+	DeletedBy string     `json:"deleted_by,omitempty" firestore:"deleted_by,omitempty"`
+	Version   string     `json:"version,omitempty" firestore:"-"`
 }
 
 // Service provides coupon CRUD operations.
@@ -20,6 +32,10 @@ type Service interface {
 	CreateCoupon(ctx context.Context, coupon Coupon) (Coupon, error)
 	GetCoupons(ctx context.Context, page, pageSize int, search string) ([]Coupon, int, error)
 	GetCoupon(ctx context.Context, id string) (Coupon, error)
-	UpdateCoupon(ctx context.Context, id string, coupon Coupon) (Coupon, error)
+	UpdateCoupon(ctx context.Context, id, version string, coupon Coupon) (Coupon, error)
+	PatchCoupon(ctx context.Context, id, version string, fields map[string]interface{}) (Coupon, error)
 	DeleteCoupon(ctx context.Context, id string) error
+	GetDeletedCoupons(ctx context.Context, page, pageSize int) ([]Coupon, int, error)
+	RestoreCoupon(ctx context.Context, id string) (Coupon, error)
+	PurgeDeletedCoupons(ctx context.Context, before time.Time) (int, error)
 }
@@ -2,10 +2,16 @@ package coupon
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
 )
 
 // FirestoreService is a Firestore implementation of the coupon service.
@@ -25,11 +31,15 @@ func NewFirestoreService(client *firestore.Client) *FirestoreService {
 func (s *FirestoreService) CreateCoupon(ctx context.Context, coupon Coupon) (Coupon, error) {
 	ref := s.client.Collection(s.collection).NewDoc()
 	coupon.ID = ref.ID
-	_, err := ref.Set(ctx, coupon)
+	now, actor := time.Now(), auth.Actor(ctx)
+	coupon.CreatedAt, coupon.UpdatedAt = now, now
+	coupon.CreatedBy, coupon.UpdatedBy = actor, actor
+	wr, err := ref.Set(ctx, coupon)
 	if err != nil {
 		log.Printf("Failed to create coupon: %v", err)
 		return Coupon{}, err
 	}
+	coupon.Version = etag.Version(wr.UpdateTime)
 	return coupon, nil
 }
 
@@ -53,6 +63,10 @@ func (s *FirestoreService) GetCoupons(ctx context.Context, page, pageSize int, s
 		}
 		var coupon Coupon
 		doc.DataTo(&coupon)
+		if coupon.DeletedAt != nil {
+			continue
+		}
+		coupon.Version = etag.Version(doc.UpdateTime)
 		coupons = append(coupons, coupon)
 	}
 
@@ -79,24 +93,211 @@ func (s *FirestoreService) GetCoupon(ctx context.Context, id string) (Coupon, er
 	}
 	var coupon Coupon
 	doc.DataTo(&coupon)
+	coupon.Version = etag.Version(doc.UpdateTime)
 	return coupon, nil
 }
 
-func (s *FirestoreService) UpdateCoupon(ctx context.Context, id string, coupon Coupon) (Coupon, error) {
-	_, err := s.client.Collection(s.collection).Doc(id).Set(ctx, coupon)
+func (s *FirestoreService) UpdateCoupon(ctx context.Context, id, version string, coupon Coupon) (Coupon, error) {
+	updateTime, err := etag.Time(version)
 	if err != nil {
-		log.Printf("Failed to update coupon: %v", err)
 		return Coupon{}, err
 	}
+	ref := s.client.Collection(s.collection).Doc(id)
 	coupon.ID = id
-	return coupon, nil
+
+	// PUT replaces the whole document, but only if it exists and has not changed since it was read.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+
+		// Creation stamps always come from the stored document, never from the request.
+		var existing Coupon
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrCouponNotFound
+		}
+		coupon.CreatedAt, coupon.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		coupon.DeletedAt, coupon.DeletedBy = nil, ""
+		coupon.UpdatedAt, coupon.UpdatedBy = time.Now(), auth.Actor(ctx)
+		return tx.Set(ref, coupon)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCouponNotFound) {
+		return Coupon{}, ErrCouponNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to update coupon: %v", err)
+		return Coupon{}, err
+	}
+	return s.GetCoupon(ctx, id)
 }
 
+func (s *FirestoreService) PatchCoupon(ctx context.Context, id, version string, fields map[string]interface{}) (Coupon, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Coupon{}, err
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
+
+	updates := []firestore.Update{
+		{Path: "updated_at", Value: time.Now()},
+		{Path: "updated_by", Value: auth.Actor(ctx)},
+	}
+	for key, value := range fields {
+		updates = append(updates, firestore.Update{Path: key, Value: value})
+	}
+
+	// Update only touches the given paths; like PUT it needs the document to be unchanged and not in the trash.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+		var existing Coupon
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrCouponNotFound
+		}
+		return tx.Update(ref, updates)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCouponNotFound) {
+		return Coupon{}, ErrCouponNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to patch coupon: %v", err)
+		return Coupon{}, err
+	}
+
+	return s.GetCoupon(ctx, id)
+}
+
+// DeleteCoupon moves the coupon to the trash; PurgeDeletedCoupons removes it for good.
 func (s *FirestoreService) DeleteCoupon(ctx context.Context, id string) error {
-	_, err := s.client.Collection(s.collection).Doc(id).Delete(ctx)
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var coupon Coupon
+		if err := doc.DataTo(&coupon); err != nil {
+			return err
+		}
+		if coupon.DeletedAt != nil {
+			return ErrCouponNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: time.Now()},
+			{Path: "deleted_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCouponNotFound) {
+		return ErrCouponNotFound
+	}
 	if err != nil {
 		log.Printf("Failed to delete coupon: %v", err)
 		return err
 	}
 	return nil
 }
+
+func (s *FirestoreService) GetDeletedCoupons(ctx context.Context, page, pageSize int) ([]Coupon, int, error) {
+	var coupons []Coupon
+	query := s.client.Collection(s.collection).Where("deleted_at", "!=", nil).OrderBy("deleted_at", firestore.Desc)
+
+	iter := query.Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted coupons: %v", err)
+			return nil, 0, err
+		}
+		var coupon Coupon
+		doc.DataTo(&coupon)
+		coupon.Version = etag.Version(doc.UpdateTime)
+		coupons = append(coupons, coupon)
+	}
+
+	totalCount := len(coupons)
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Coupon{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	return coupons[start:end], totalCount, nil
+}
+
+func (s *FirestoreService) RestoreCoupon(ctx context.Context, id string) (Coupon, error) {
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var coupon Coupon
+		if err := doc.DataTo(&coupon); err != nil {
+			return err
+		}
+		if coupon.DeletedAt == nil {
+			return ErrCouponNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: nil},
+			{Path: "deleted_by", Value: firestore.Delete},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrCouponNotFound) {
+		return Coupon{}, ErrCouponNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to restore coupon: %v", err)
+		return Coupon{}, err
+	}
+	return s.GetCoupon(ctx, id)
+}
+
+// PurgeDeletedCoupons permanently removes coupons that were moved to the trash before the given time.
+func (s *FirestoreService) PurgeDeletedCoupons(ctx context.Context, before time.Time) (int, error) {
+	iter := s.client.Collection(s.collection).Where("deleted_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted coupons: %v", err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge coupon %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
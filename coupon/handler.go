@@ -2,12 +2,26 @@ package coupon
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
 	"suto-e-shop-api/pkg/pagination"
+	"suto-e-shop-api/pkg/patch"
 )
 
+// couponPatchRules lists the fields a PATCH request may change.
+var couponPatchRules = map[string]patch.Rule{
+	"name":       patch.RequiredString(),
+	"code":       patch.RequiredString(),
+	"percent":    patch.Int(1, 100),
+	"start_time": patch.Int(0, math.MaxInt64),
+	"end_time":   patch.Int(0, math.MaxInt64),
+	"is_enabled": patch.Bool(),
+}
+
 // Handler holds the coupon service.
 type Handler struct {
 	service Service
@@ -24,9 +38,12 @@ func (h *Handler) RegisterRoutes(router *mux.Router) {
 
 	adminRouter.HandleFunc("", h.CreateCoupon).Methods("POST")
 	adminRouter.HandleFunc("", h.GetCoupons).Methods("GET")
+	adminRouter.HandleFunc("/trash", h.GetDeletedCoupons).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.GetCoupon).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.UpdateCoupon).Methods("PUT")
+	adminRouter.HandleFunc("/{id}", h.PatchCoupon).Methods("PATCH")
 	adminRouter.HandleFunc("/{id}", h.DeleteCoupon).Methods("DELETE")
+	adminRouter.HandleFunc("/{id}/restore", h.RestoreCoupon).Methods("POST")
 }
 
 func (h *Handler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +59,7 @@ func (h *Handler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, createdCoupon.Version)
 	RespondWithJSON(w, http.StatusCreated, Response{Data: createdCoupon, Message: "success", Code: 0})
 }
 
@@ -75,6 +93,7 @@ func (h *Handler) GetCoupon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, coupon.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: coupon, Message: "success", Code: 0})
 }
 
@@ -82,18 +101,73 @@ func (h *Handler) UpdateCoupon(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
 	var coupon Coupon
 	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	updatedCoupon, err := h.service.UpdateCoupon(r.Context(), id, coupon)
+	updatedCoupon, err := h.service.UpdateCoupon(r.Context(), id, version, coupon)
+	if errors.Is(err, ErrCouponNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
 	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedCoupon.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedCoupon, Message: "success", Code: 0})
+}
+
+func (h *Handler) PatchCoupon(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	fields, err := patch.Validate(data, couponPatchRules)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updatedCoupon, err := h.service.PatchCoupon(r.Context(), id, version, fields)
+	if errors.Is(err, ErrCouponNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Coupon not found")
 		return
 	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	etag.SetHeader(w, updatedCoupon.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: updatedCoupon, Message: "success", Code: 0})
 }
 
@@ -101,10 +175,52 @@ func (h *Handler) DeleteCoupon(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := h.service.DeleteCoupon(r.Context(), id); err != nil {
+	err := h.service.DeleteCoupon(r.Context(), id)
+	if errors.Is(err, ErrCouponNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Coupon not found")
 		return
 	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
 }
+
+func (h *Handler) GetDeletedCoupons(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := pagination.GetPaginationParams(r)
+
+	coupons, totalCount, err := h.service.GetDeletedCoupons(r.Context(), page, pageSize)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       coupons,
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
+}
+
+func (h *Handler) RestoreCoupon(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	coupon, err := h.service.RestoreCoupon(r.Context(), id)
+	if errors.Is(err, ErrCouponNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Coupon not found in trash")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, coupon.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: coupon, Message: "success", Code: 0})
+}
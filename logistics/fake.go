@@ -0,0 +1,233 @@
+package logistics
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeStores are the stores listed on the fake store map.
+var fakeStores = map[string][]Store{
+	ChainSevenEleven: {
+		{Chain: ChainSevenEleven, Code: "900001", Name: "測試一門市", Address: "台北市中正區測試路1號"},
+		{Chain: ChainSevenEleven, Code: "900002", Name: "測試二門市", Address: "台中市西區測試路2號"},
+		{Chain: ChainSevenEleven, Code: "900003", Name: "測試澎湖門市", Address: "澎湖縣馬公市測試路3號"},
+	},
+	ChainFamilyMart: {
+		{Chain: ChainFamilyMart, Code: "F90001", Name: "全家測試一店", Address: "台北市大安區測試街1號"},
+		{Chain: ChainFamilyMart, Code: "F90002", Name: "全家測試二店", Address: "高雄市前鎮區測試街2號"},
+	},
+}
+
+var fakeMapTemplate = template.Must(template.New("map").Parse(`<!DOCTYPE html>
+<html lang="zh-Hant">
+<head><meta charset="utf-8"><title>測試門市地圖</title></head>
+<body>
+<h1>測試門市地圖</h1>
+<p>這是離線測試用的假物流，選擇門市後會回到商店。</p>
+{{range .}}
+<form method="post" action="{{.Callback}}">
+<input type="hidden" name="chain" value="{{.Store.Chain}}">
+<input type="hidden" name="code" value="{{.Store.Code}}">
+<input type="hidden" name="name" value="{{.Store.Name}}">
+<input type="hidden" name="address" value="{{.Store.Address}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="signature" value="{{.Signature}}">
+<button type="submit">{{.Store.Name}}（{{.Store.Code}}）{{.Store.Address}}</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// FakeProvider is a logistics provider that runs inside this API, so the store selection,
+// shipment and webhook flow can be tried without a carrier. It serves its own store map, hands out
+// FAKE tracking numbers and lets admins push status webhooks. Callbacks and webhooks are signed
+// with a configured secret, like a carrier's merchant key, so they stay valid across instances and restarts.
+type FakeProvider struct {
+	baseURL string
+	secret  []byte
+	client  *http.Client
+}
+
+// NewFakeProvider creates a fake provider for the API served at baseURL.
+func NewFakeProvider(baseURL, secret string) *FakeProvider {
+	return &FakeProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) StoreSelectionURL(chain, callbackURL, state string) (string, error) {
+	if !slices.Contains(Chains, chain) {
+		return "", ErrInvalidChain
+	}
+	query := url.Values{"chain": {chain}, "callback": {callbackURL}, "state": {state}}
+	return p.baseURL + "/logistics/fake/map?" + query.Encode(), nil
+}
+
+func (p *FakeProvider) ParseStoreSelection(r *http.Request) (Store, string, error) {
+	if err := r.ParseForm(); err != nil {
+		return Store{}, "", ErrInvalidCallback
+	}
+	store := Store{
+		Chain:   r.PostForm.Get("chain"),
+		Code:    r.PostForm.Get("code"),
+		Name:    r.PostForm.Get("name"),
+		Address: r.PostForm.Get("address"),
+	}
+	state := r.PostForm.Get("state")
+	if !hmac.Equal([]byte(p.storeSignature(store, state)), []byte(r.PostForm.Get("signature"))) {
+		return Store{}, "", ErrInvalidCallback
+	}
+	return store, state, nil
+}
+
+func (p *FakeProvider) CreateShipment(ctx context.Context, req ShipmentRequest) (Shipment, error) {
+	if !slices.Contains(Chains, req.StoreChain) {
+		return Shipment{}, ErrInvalidChain
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1e10))
+	if err != nil {
+		return Shipment{}, err
+	}
+	now := time.Now()
+	return Shipment{
+		Provider:       p.Name(),
+		TrackingNumber: fmt.Sprintf("FAKE%010d", n),
+		Status:         StatusCreated,
+		StatusAt:       now,
+		CreatedAt:      now,
+	}, nil
+}
+
+func (p *FakeProvider) ParseStatusWebhook(r *http.Request) (StatusUpdate, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return StatusUpdate{}, ErrInvalidWebhook
+	}
+	if !hmac.Equal([]byte(p.sign(string(body))), []byte(r.Header.Get("X-Fake-Signature"))) {
+		return StatusUpdate{}, ErrInvalidWebhook
+	}
+	var update StatusUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		return StatusUpdate{}, ErrInvalidWebhook
+	}
+	if update.TrackingNumber == "" || !slices.Contains(Statuses, update.Status) || update.At.IsZero() {
+		return StatusUpdate{}, ErrInvalidWebhook
+	}
+	update.Provider = p.Name()
+	return update, nil
+}
+
+func (p *FakeProvider) AcknowledgeWebhook(w http.ResponseWriter) {
+	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
+}
+
+// RegisterClientRoutes registers the fake store map to the router.
+func (p *FakeProvider) RegisterClientRoutes(router *mux.Router) {
+	router.HandleFunc("/logistics/fake/map", p.StoreMap).Methods("GET")
+}
+
+// RegisterAdminRoutes registers the route that pushes status webhooks to the router.
+func (p *FakeProvider) RegisterAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/logistics/fake/shipments/{tracking_number}/status", p.PushStatus).Methods("POST")
+}
+
+// StoreMap lists the fake stores of a chain, each posting itself back to the callback.
+func (p *FakeProvider) StoreMap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	stores, ok := fakeStores[query.Get("chain")]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrInvalidChain.Error())
+		return
+	}
+	callback, err := url.Parse(query.Get("callback"))
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") {
+		RespondWithError(w, http.StatusBadRequest, "callback must be an http or https URL")
+		return
+	}
+
+	type entry struct {
+		Store     Store
+		Callback  string
+		State     string
+		Signature string
+	}
+	state := query.Get("state")
+	entries := make([]entry, len(stores))
+	for i, store := range stores {
+		entries[i] = entry{Store: store, Callback: callback.String(), State: state, Signature: p.storeSignature(store, state)}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fakeMapTemplate.Execute(w, entries)
+}
+
+// PushStatus sends a signed status webhook for a shipment to this API, the way a carrier would.
+func (p *FakeProvider) PushStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !slices.Contains(Statuses, req.Status) {
+		RespondWithError(w, http.StatusBadRequest, "status must be one of "+strings.Join(Statuses, ", "))
+		return
+	}
+
+	body, _ := json.Marshal(StatusUpdate{
+		TrackingNumber: mux.Vars(r)["tracking_number"],
+		Status:         req.Status,
+		At:             time.Now(),
+	})
+	webhook, err := http.NewRequestWithContext(r.Context(), "POST", p.baseURL+"/logistics/webhook", bytes.NewReader(body))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	webhook.Header.Set("Content-Type", "application/json")
+	webhook.Header.Set("X-Fake-Signature", p.sign(string(body)))
+	resp, err := p.client.Do(webhook)
+	if err != nil {
+		RespondWithError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	// Relay the webhook's reply, so a tracking number without an order shows up as its 404.
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *FakeProvider) storeSignature(store Store, state string) string {
+	return p.sign(strings.Join([]string{store.Chain, store.Code, store.Name, store.Address, state}, "\n"))
+}
+
+func (p *FakeProvider) sign(data string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,114 @@
+package logistics
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Handler runs the store selection and webhook flows of a provider.
+type Handler struct {
+	provider      Provider
+	shipments     ShipmentUpdater
+	stores        *StoreSigner
+	baseURL       string
+	storefrontURL string
+}
+
+// NewHandler creates a new logistics handler. baseURL is where this API is served, for the
+// provider to call back, and storefrontURL is where shoppers return after choosing a store.
+// stores signs the chosen store, for the order to prove it came from the map.
+func NewHandler(provider Provider, shipments ShipmentUpdater, stores *StoreSigner, baseURL, storefrontURL string) *Handler {
+	return &Handler{
+		provider:      provider,
+		shipments:     shipments,
+		stores:        stores,
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		storefrontURL: strings.TrimRight(storefrontURL, "/"),
+	}
+}
+
+// RegisterClientRoutes registers the client logistics routes to the router.
+func (h *Handler) RegisterClientRoutes(router *mux.Router) {
+	router.HandleFunc("/logistics/stores/select", h.SelectStore).Methods("GET")
+	router.HandleFunc("/logistics/stores/callback", h.StoreCallback).Methods("POST")
+	router.HandleFunc("/logistics/webhook", h.Webhook).Methods("POST")
+}
+
+// SelectStore sends the shopper to the provider's store map. return_path is the storefront page to
+// come back to, which gets the chosen store as store_chain, store_code, store_name and store_address,
+// plus the store_token an order to that store needs.
+func (h *Handler) SelectStore(w http.ResponseWriter, r *http.Request) {
+	returnPath := r.URL.Query().Get("return_path")
+	if !validReturnPath(returnPath) {
+		RespondWithError(w, http.StatusBadRequest, "return_path must be a path on the storefront like /checkout")
+		return
+	}
+
+	mapURL, err := h.provider.StoreSelectionURL(r.URL.Query().Get("chain"), h.baseURL+"/logistics/stores/callback", returnPath)
+	if errors.Is(err, ErrInvalidChain) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.Redirect(w, r, mapURL, http.StatusFound)
+}
+
+// StoreCallback receives the store the shopper chose and sends them back to the storefront.
+func (h *Handler) StoreCallback(w http.ResponseWriter, r *http.Request) {
+	store, returnPath, err := h.provider.ParseStoreSelection(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validReturnPath(returnPath) {
+		RespondWithError(w, http.StatusBadRequest, ErrInvalidCallback.Error())
+		return
+	}
+
+	target, err := url.Parse(h.storefrontURL + returnPath)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, ErrInvalidCallback.Error())
+		return
+	}
+	query := target.Query()
+	query.Set("store_chain", store.Chain)
+	query.Set("store_code", store.Code)
+	query.Set("store_name", store.Name)
+	query.Set("store_address", store.Address)
+	query.Set("store_token", h.stores.Sign(store.Chain, store.Code, time.Now()))
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// Webhook applies a status update reported by the provider to the order it belongs to.
+func (h *Handler) Webhook(w http.ResponseWriter, r *http.Request) {
+	update, err := h.provider.ParseStatusWebhook(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = h.shipments.UpdateShipmentStatus(r.Context(), update)
+	if errors.Is(err, ErrShipmentNotFound) {
+		RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.provider.AcknowledgeWebhook(w)
+}
+
+// validReturnPath allows only paths on the storefront, so the callback cannot redirect elsewhere.
+func validReturnPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.Contains(path, `\`)
+}
@@ -0,0 +1,100 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Convenience-store chains that parcels can be picked up at.
+const (
+	ChainSevenEleven = "seven_eleven"
+	ChainFamilyMart  = "family_mart"
+)
+
+// Chains lists every supported convenience-store chain.
+var Chains = []string{ChainSevenEleven, ChainFamilyMart}
+
+// Shipment statuses, in the order a parcel normally goes through them. A parcel that is not
+// picked up in time is returned to the shop.
+const (
+	StatusCreated   = "created"
+	StatusInTransit = "in_transit"
+	StatusArrived   = "arrived"
+	StatusPickedUp  = "picked_up"
+	StatusReturned  = "returned"
+)
+
+// Statuses lists every shipment status.
+var Statuses = []string{StatusCreated, StatusInTransit, StatusArrived, StatusPickedUp, StatusReturned}
+
+var (
+	// ErrInvalidChain is returned for a chain that is not in Chains.
+	ErrInvalidChain = errors.New("invalid store chain, use one of seven_eleven, family_mart")
+	// ErrInvalidCallback is returned when a store selection callback is malformed or not signed by the provider.
+	ErrInvalidCallback = errors.New("invalid store selection callback")
+	// ErrInvalidWebhook is returned when a status webhook is malformed or not signed by the provider.
+	ErrInvalidWebhook = errors.New("invalid status webhook")
+	// ErrShipmentNotFound is returned when a webhook names a tracking number no order has.
+	ErrShipmentNotFound = errors.New("shipment not found")
+)
+
+// Store is a convenience store chosen on the provider's store map.
+type Store struct {
+	Chain   string `json:"chain"`
+	Code    string `json:"code"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// ShipmentRequest is what a provider needs to ship an order to a store. Amount is the declared value.
+type ShipmentRequest struct {
+	OrderID       string
+	ReceiverName  string
+	ReceiverPhone string
+	StoreChain    string
+	StoreCode     string
+	Amount        int
+}
+
+// Shipment is a parcel registered with a provider, stored on its order.
+type Shipment struct {
+	Provider       string    `json:"provider" firestore:"provider"`
+	TrackingNumber string    `json:"tracking_number" firestore:"tracking_number"`
+	Status         string    `json:"status" firestore:"status"`
+	StatusAt       time.Time `json:"status_at" firestore:"status_at"`
+	CreatedAt      time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// StatusUpdate is a status change reported by a provider's webhook.
+type StatusUpdate struct {
+	Provider       string    `json:"provider"`
+	TrackingNumber string    `json:"tracking_number"`
+	Status         string    `json:"status"`
+	At             time.Time `json:"at"`
+}
+
+// Provider is a logistics carrier. Each carrier has its own adapter; FakeProvider stands in for
+// them when developing offline.
+type Provider interface {
+	Name() string
+
+	// StoreSelectionURL is the carrier's store map for the chain. The carrier sends the chosen store
+	// to callbackURL, together with state, where ParseStoreSelection reads them back.
+	StoreSelectionURL(chain, callbackURL, state string) (string, error)
+	ParseStoreSelection(r *http.Request) (Store, string, error)
+
+	// CreateShipment registers a parcel and returns it with its tracking number.
+	CreateShipment(ctx context.Context, req ShipmentRequest) (Shipment, error)
+
+	// ParseStatusWebhook verifies and reads a status webhook, and AcknowledgeWebhook writes the
+	// reply the carrier expects so it stops retrying.
+	ParseStatusWebhook(r *http.Request) (StatusUpdate, error)
+	AcknowledgeWebhook(w http.ResponseWriter)
+}
+
+// ShipmentUpdater applies webhook status updates to the shipments of orders.
+type ShipmentUpdater interface {
+	UpdateShipmentStatus(ctx context.Context, update StatusUpdate) error
+}
@@ -0,0 +1,57 @@
+package logistics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoreTokenTTL is how long a store chosen on the map can be ordered to.
+const StoreTokenTTL = 24 * time.Hour
+
+// ErrInvalidStoreToken is returned when an order's store was not chosen on the store map or was chosen too long ago.
+var ErrInvalidStoreToken = errors.New("store_token is missing or expired, choose the store again")
+
+// StoreSigner vouches for the stores shoppers chose on the provider's map. The callback hands the
+// storefront a token for the chosen chain and code, and an order to that store must bring it along,
+// so a store that was never offered by the map cannot be ordered to.
+type StoreSigner struct {
+	secret []byte
+}
+
+// NewStoreSigner creates a store signer with the given secret.
+func NewStoreSigner(secret string) *StoreSigner {
+	return &StoreSigner{secret: []byte(secret)}
+}
+
+// Sign returns the token for a store chosen at now. It reads as expiry.signature.
+func (s *StoreSigner) Sign(chain, code string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(StoreTokenTTL).Unix(), 10)
+	return expires + "." + s.signature(chain, code, expires)
+}
+
+// VerifyStore checks that token was signed for the chain and code and has not expired at now.
+func (s *StoreSigner) VerifyStore(chain, code, token string, now time.Time) error {
+	expires, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidStoreToken
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !now.Before(time.Unix(unix, 0)) {
+		return ErrInvalidStoreToken
+	}
+	if !hmac.Equal([]byte(s.signature(chain, code, expires)), []byte(signature)) {
+		return ErrInvalidStoreToken
+	}
+	return nil
+}
+
+func (s *StoreSigner) signature(chain, code, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join([]string{chain, code, expires}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
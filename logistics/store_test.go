@@ -0,0 +1,71 @@
+package logistics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreSignerVerifyStore(t *testing.T) {
+	signer := NewStoreSigner("secret")
+	chosenAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	token := signer.Sign(ChainSevenEleven, "900001", chosenAt)
+	expires, signature, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name    string
+		signer  *StoreSigner
+		chain   string
+		code    string
+		token   string
+		now     time.Time
+		wantErr bool
+	}{
+		{"same store", signer, ChainSevenEleven, "900001", token, chosenAt.Add(time.Hour), false},
+		{"just before expiry", signer, ChainSevenEleven, "900001", token, chosenAt.Add(StoreTokenTTL - time.Second), false},
+		{"at expiry", signer, ChainSevenEleven, "900001", token, chosenAt.Add(StoreTokenTTL), true},
+		{"other code", signer, ChainSevenEleven, "900002", token, chosenAt, true},
+		{"other chain", signer, ChainFamilyMart, "900001", token, chosenAt, true},
+		{"other secret", NewStoreSigner("other"), ChainSevenEleven, "900001", token, chosenAt, true},
+		{"extended expiry", signer, ChainSevenEleven, "900001", "9999999999." + signature, chosenAt, true},
+		{"tampered signature", signer, ChainSevenEleven, "900001", expires + "." + strings.Repeat("0", len(signature)), chosenAt, true},
+		{"no separator", signer, ChainSevenEleven, "900001", signature, chosenAt, true},
+		{"expiry not a number", signer, ChainSevenEleven, "900001", "soon." + signature, chosenAt, true},
+		{"empty", signer, ChainSevenEleven, "900001", "", chosenAt, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signer.VerifyStore(tt.chain, tt.code, tt.token, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidStoreToken) {
+				t.Errorf("VerifyStore() error = %v, want ErrInvalidStoreToken", err)
+			}
+		})
+	}
+}
+
+func TestValidReturnPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/checkout", true},
+		{"/checkout?step=2", true},
+		{"/", true},
+		{"", false},
+		{"checkout", false},
+		{"//evil.example", false},
+		{`/\evil.example`, false},
+		{"https://evil.example/checkout", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := validReturnPath(tt.path); got != tt.want {
+				t.Errorf("validReturnPath(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
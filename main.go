@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/storage"
@@ -14,8 +18,12 @@ import (
 	"suto-e-shop-api/auth"
 	"suto-e-shop-api/category"
 	"suto-e-shop-api/coupon"
+	"suto-e-shop-api/logistics"
 	"suto-e-shop-api/order"
+	"suto-e-shop-api/pkg/ratelimit"
+	"suto-e-shop-api/pkg/scheduler"
 	"suto-e-shop-api/product"
+	"suto-e-shop-api/shipping"
 	"suto-e-shop-api/upload"
 )
 
@@ -39,8 +47,9 @@ func CORSMiddleware(allowedOrigins []string) mux.MiddlewareFunc {
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
 			}
 
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Auth-Token")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Auth-Token, If-Match, Idempotency-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Retry-After")
 
 			// Continue to the next handler
 			next.ServeHTTP(w, r)
@@ -73,19 +82,25 @@ func main() {
 		log.Fatalf("Failed to create Firebase app: %v", err)
 	}
 
-	// Initialize Cloud Storage Client
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Fatalf("Failed to create Storage client: %v", err)
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
 	}
-	defer storageClient.Close()
 
-	// Get Storage bucket name from environment variable or use default
-	storageBucket := os.Getenv("STORAGE_BUCKET")
-	if storageBucket == "" {
-		storageBucket = projectID + ".appspot.com"
+	// Where this API and the storefront are reached from outside, for redirects and callbacks
+	baseURL := os.Getenv("API_BASE_URL")
+	storefrontURL := os.Getenv("STOREFRONT_URL")
+	if storefrontURL == "" {
+		storefrontURL = "https://suto-e-shop.netlify.app"
 	}
 
+	// Initialize the upload backend
+	uploadBackend, stagingBackend, publicBaseURL, closeBackend, err := newUploadBackend(ctx, projectID, port)
+	if err != nil {
+		log.Fatalf("Failed to create upload backend: %v", err)
+	}
+	defer closeBackend()
+
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 
@@ -93,6 +108,29 @@ func main() {
 	allowedOrigins := []string{"http://localhost:5173", "http://localhost:3000", "https://suto-e-shop.netlify.app"}
 	r.Use(CORSMiddleware(allowedOrigins))
 
+	// Throttle the public endpoints per client IP; RATE_LIMITS overrides or adds routes
+	rateLimits := map[string]ratelimit.Limit{
+		"POST /order":                  {Requests: 5, Per: time.Minute},
+		"GET /order":                   {Requests: 30, Per: time.Minute},
+		"POST /products/ids":           {Requests: 60, Per: time.Minute},
+		"POST /shipping/quote":         {Requests: 60, Per: time.Minute},
+		"POST /advertises/impressions": {Requests: 60, Per: time.Minute},
+		"GET /advertises/{id}/click":   {Requests: 30, Per: time.Minute},
+	}
+	overrides, err := ratelimit.ParseLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMITS: %v", err)
+	}
+	for route, limit := range overrides {
+		rateLimits[route] = limit
+	}
+	trustedProxies, err := ratelimit.ParsePrefixes(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), trustedProxies)
+	r.Use(limiter.Middleware(rateLimits))
+
 	// Add a handler for OPTIONS requests to handle preflight CORS requests.
 	r.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
@@ -102,46 +140,245 @@ func main() {
 	adminRouter := r.PathPrefix("/admin").Subrouter()
 	adminRouter.Use(auth.FirebaseJWTMiddleware(fbApp))
 
-	// Product routes
-	productService := product.NewFirestoreService(client)
-	productHandler := product.NewHandler(productService)
-	productHandler.RegisterClientRoutes(r)
-	productHandler.RegisterAdminRoutes(adminRouter)
-
 	// Coupon routes
 	couponService := coupon.NewFirestoreService(client)
 	couponHandler := coupon.NewHandler(couponService)
 	couponHandler.RegisterRoutes(adminRouter)
 
-	// Order routes
-	orderService := order.NewFirestoreService(client)
-	orderHandler := order.NewHandler(orderService)
+	// Shipping routes; orders are charged by the same rules the quote endpoint previews
+	shippingService := shipping.NewFirestoreService(client)
+	shippingHandler := shipping.NewHandler(shippingService)
+	shippingHandler.RegisterClientRoutes(r)
+	shippingHandler.RegisterAdminRoutes(adminRouter)
+
+	// Logistics provider for convenience-store pickup; without one that method is not offered
+	logisticsProvider, err := newLogisticsProvider(baseURL)
+	if err != nil {
+		log.Fatalf("Failed to create logistics provider: %v", err)
+	}
+	var storeSigner *logistics.StoreSigner
+	var storeVerifier order.StoreVerifier
+	if logisticsProvider != nil {
+		storeSecret := os.Getenv("LOGISTICS_STORE_SECRET")
+		if storeSecret == "" {
+			log.Fatal("LOGISTICS_STORE_SECRET environment variable must be set with LOGISTICS_PROVIDER.")
+		}
+		storeSigner = logistics.NewStoreSigner(storeSecret)
+		storeVerifier = storeSigner
+	}
+
+	// Order routes; convenience-store orders need the store token the store map handed out
+	orderService := order.NewFirestoreService(client, shippingService, logisticsProvider)
+	orderHandler := order.NewHandler(orderService, storeVerifier)
 	orderHandler.RegisterClientRoutes(r)
 	orderHandler.RegisterAdminRoutes(adminRouter)
 
-	// Category routes
+	// Logistics routes; the provider calls back here and the webhook updates the orders
+	if logisticsProvider != nil {
+		logisticsHandler := logistics.NewHandler(logisticsProvider, orderService, storeSigner, baseURL, storefrontURL)
+		logisticsHandler.RegisterClientRoutes(r)
+		if fake, ok := logisticsProvider.(*logistics.FakeProvider); ok {
+			// Serves the store map and lets admins push status webhooks
+			fake.RegisterClientRoutes(r)
+			fake.RegisterAdminRoutes(adminRouter)
+		}
+	}
+
+	// The category page lists products and product filters expand categories, so both services come first.
+	productService := product.NewFirestoreService(client)
 	categoryService := category.NewFirestoreService(client)
-	categoryHandler := category.NewHandler(categoryService)
+
+	// Category routes
+	categoryHandler := category.NewHandler(categoryService, productService)
 	categoryHandler.RegisterClientRoutes(r)
 	categoryHandler.RegisterAdminRoutes(adminRouter)
 
+	// Product routes
+	productHandler := product.NewHandler(productService, categoryService)
+	productHandler.RegisterClientRoutes(r)
+	productHandler.RegisterAdminRoutes(adminRouter)
+
 	// Upload routes
-	uploadService := upload.NewStorageService(storageClient, storageBucket)
-	uploadHandler := upload.NewHandler(uploadService)
+	uploadService := upload.NewStorageService(uploadBackend, stagingBackend, publicBaseURL, client)
+	allowSVG, _ := strconv.ParseBool(os.Getenv("ALLOW_SVG_UPLOADS"))
+	uploadHandler := upload.NewHandler(uploadService, allowSVG)
 	uploadHandler.RegisterAdminRoutes(adminRouter)
+	if local, ok := uploadBackend.(*upload.LocalBackend); ok {
+		// Serves the files of the local backend
+		r.PathPrefix("/files/").Handler(http.StripPrefix("/files", local))
+	}
+	if staging, ok := stagingBackend.(*upload.LocalBackend); ok {
+		// Accepts the signed PUT requests of direct uploads
+		r.PathPrefix("/staging/").Handler(http.StripPrefix("/staging", staging))
+	}
 
 	// Advertise routes
 	advertiseService := advertise.NewFirestoreService(client)
-	advertiseHandler := advertise.NewHandler(advertiseService)
+	advertiseHandler := advertise.NewHandler(advertiseService, productService, categoryService, storefrontURL)
 	advertiseHandler.RegisterClientRoutes(r)
 	advertiseHandler.RegisterAdminRoutes(adminRouter)
 
+	// Permanently remove soft-deleted catalog entries once they have been in the trash long enough
+	retention := trashRetention()
+	purgeJobs := map[string]func(ctx context.Context, before time.Time) (int, error){
+		"products":   productService.PurgeDeletedProducts,
+		"categories": categoryService.PurgeDeletedCategories,
+		"coupons":    couponService.PurgeDeletedCoupons,
+		"advertises": advertiseService.PurgeDeletedAdvertises,
+	}
+	for name, purge := range purgeJobs {
+		scheduler.Every(ctx, "purge deleted "+name, 6*time.Hour, func(ctx context.Context) error {
+			purged, err := purge(ctx, time.Now().Add(-retention))
+			if purged > 0 {
+				log.Printf("Purged %d deleted %s", purged, name)
+			}
+			return err
+		})
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Remove uploads that nothing has referenced for a while
+	orphanRetentionDays := 7
+	if days, err := strconv.Atoi(os.Getenv("MEDIA_ORPHAN_DAYS")); err == nil && days > 0 {
+		orphanRetentionDays = days
 	}
+	orphanRetention := time.Duration(orphanRetentionDays) * 24 * time.Hour
+	orphanDryRun, _ := strconv.ParseBool(os.Getenv("MEDIA_PURGE_DRY_RUN"))
+	scheduler.Every(ctx, "purge orphan media", 24*time.Hour, func(ctx context.Context) error {
+		purged, err := uploadService.PurgeOrphanAssets(ctx, time.Now().Add(-orphanRetention), orphanDryRun)
+		if purged > 0 && orphanDryRun {
+			log.Printf("Would purge %d orphan media assets", purged)
+		} else if purged > 0 {
+			log.Printf("Purged %d orphan media assets", purged)
+		}
+		return err
+	})
+
+	// Remove direct uploads that were never finalized once their signed URL has expired
+	scheduler.Every(ctx, "purge expired uploads", time.Hour, func(ctx context.Context) error {
+		purged, err := uploadService.PurgeExpiredUploads(ctx, time.Now())
+		if purged > 0 {
+			log.Printf("Purged %d expired staged uploads", purged)
+		}
+		return err
+	})
+
+	// Forget idempotency keys of order creation once they have expired
+	scheduler.Every(ctx, "purge expired idempotency keys", time.Hour, func(ctx context.Context) error {
+		purged, err := orderService.PurgeExpiredIdempotencyKeys(ctx, time.Now())
+		if purged > 0 {
+			log.Printf("Purged %d expired idempotency keys", purged)
+		}
+		return err
+	})
 
 	log.Println("Server listening on port", port)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
+
+// trashRetention is how long soft-deleted entries stay restorable: TRASH_RETENTION_DAYS, or 30 days
+// when it is unset or not a positive number.
+func trashRetention() time.Duration {
+	days := 30
+	if n, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && n > 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// newUploadBackend creates the backend chosen by UPLOAD_BACKEND (gcs, local or s3) and returns it
+// together with the private backend that stages direct uploads, and the public base URL its files
+// are served from, which PUBLIC_BASE_URL overrides. The staging backend is nil when no private
+// bucket is configured, which disables direct uploads.
+func newUploadBackend(ctx context.Context, projectID, port string) (upload.Backend, upload.Backend, string, func(), error) {
+	publicBaseURL := os.Getenv("PUBLIC_BASE_URL")
+
+	switch backend := os.Getenv("UPLOAD_BACKEND"); backend {
+	case "", "gcs":
+		// Initialize Cloud Storage Client
+		storageClient, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
+
+		// Get Storage bucket name from environment variable or use default
+		storageBucket := os.Getenv("STORAGE_BUCKET")
+		if storageBucket == "" {
+			storageBucket = projectID + ".appspot.com"
+		}
+		if publicBaseURL == "" {
+			publicBaseURL = "https://storage.googleapis.com/" + storageBucket
+		}
+		var staging upload.Backend
+		if stagingBucket := os.Getenv("STAGING_BUCKET"); stagingBucket != "" {
+			staging = upload.NewGCSBackend(storageClient, stagingBucket)
+		}
+		return upload.NewGCSBackend(storageClient, storageBucket), staging, publicBaseURL, func() { storageClient.Close() }, nil
+
+	case "local":
+		dir := os.Getenv("LOCAL_UPLOAD_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		stagingDir := os.Getenv("LOCAL_STAGING_DIR")
+		if stagingDir == "" {
+			stagingDir = "uploads-staging"
+		}
+		if publicBaseURL == "" {
+			publicBaseURL = "http://localhost:" + port + "/files"
+		}
+		local, err := upload.NewLocalBackend(dir, publicBaseURL)
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
+		staging, err := upload.NewLocalStagingBackend(stagingDir, "http://localhost:"+port+"/staging")
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
+		return local, staging, publicBaseURL, func() {}, nil
+
+	case "s3":
+		endpoint, bucket := os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET")
+		if endpoint == "" || bucket == "" {
+			return nil, nil, "", nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set for the s3 upload backend")
+		}
+		if publicBaseURL == "" {
+			publicBaseURL = strings.TrimRight(endpoint, "/") + "/" + bucket
+		}
+		region, accessKeyID, secretAccessKey := os.Getenv("S3_REGION"), os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY")
+		var staging upload.Backend
+		if stagingBucket := os.Getenv("S3_STAGING_BUCKET"); stagingBucket != "" {
+			staging = upload.NewS3Backend(endpoint, region, stagingBucket, accessKeyID, secretAccessKey)
+		}
+		s3 := upload.NewS3Backend(endpoint, region, bucket, accessKeyID, secretAccessKey)
+		return s3, staging, publicBaseURL, func() {}, nil
+
+	default:
+		return nil, nil, "", nil, fmt.Errorf("unknown UPLOAD_BACKEND %q", backend)
+	}
+}
+
+// newLogisticsProvider picks the convenience-store logistics provider from LOGISTICS_PROVIDER, or
+// returns nil when it is unset. The fake provider is for development and also needs ALLOW_FAKE_LOGISTICS,
+// so a deployment cannot end up on it by copying a development config.
+func newLogisticsProvider(baseURL string) (logistics.Provider, error) {
+	provider := os.Getenv("LOGISTICS_PROVIDER")
+	if provider == "" {
+		return nil, nil
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("API_BASE_URL must be set for the provider to call back")
+	}
+	switch provider {
+	case "fake":
+		if allow, _ := strconv.ParseBool(os.Getenv("ALLOW_FAKE_LOGISTICS")); !allow {
+			return nil, fmt.Errorf("the fake provider is for development, set ALLOW_FAKE_LOGISTICS=true to use it")
+		}
+		secret := os.Getenv("LOGISTICS_FAKE_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("LOGISTICS_FAKE_SECRET must be set for the fake provider")
+		}
+		return logistics.NewFakeProvider(baseURL, secret), nil
+	default:
+		return nil, fmt.Errorf("unknown LOGISTICS_PROVIDER %q", provider)
+	}
+}
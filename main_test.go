@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrashRetention(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * 24 * time.Hour},
+		{"7", 7 * 24 * time.Hour},
+		{"0", 30 * 24 * time.Hour},
+		{"-1", 30 * 24 * time.Hour},
+		{"a week", 30 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Setenv("TRASH_RETENTION_DAYS", tt.value)
+		if got := trashRetention(); got != tt.want {
+			t.Errorf("trashRetention() with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
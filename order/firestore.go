@@ -3,29 +3,48 @@ package order
 import (
 	"context"
 	"log"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/logistics"
+	"suto-e-shop-api/pkg/etag"
+	"suto-e-shop-api/shipping"
 )
 
 // FirestoreService is a Firestore implementation of the order service.
 type FirestoreService struct {
-	client     *firestore.Client
-	collection string
+	client                *firestore.Client
+	collection            string
+	idempotencyCollection string
+	shipping              ShippingQuoter
+	logistics             logistics.Provider
 }
 
-// NewFirestoreService creates a new Firestore-backed order service.
-func NewFirestoreService(client *firestore.Client) *FirestoreService {
+// NewFirestoreService creates a new Firestore-backed order service that charges shipping as quoted
+// and ships convenience-store orders with the given provider.
+func NewFirestoreService(client *firestore.Client, quoter ShippingQuoter, provider logistics.Provider) *FirestoreService {
 	return &FirestoreService{
-		client:     client,
-		collection: "orders",
+		client:                client,
+		collection:            "orders",
+		idempotencyCollection: "idempotency_keys",
+		shipping:              quoter,
+		logistics:             provider,
 	}
 }
 
-func (s *FirestoreService) GetOrders(ctx context.Context, page, pageSize int, search string) ([]Order, int, error) {
+// GetOrders lists orders for the admin. search matches the name, mail or phone, and a non-empty
+// fulfillment keeps only orders with that method.
+func (s *FirestoreService) GetOrders(ctx context.Context, page, pageSize int, search, fulfillment string) ([]Order, int, error) {
+	if fulfillment != "" && !slices.Contains(FulfillmentMethods, fulfillment) {
+		return nil, 0, ErrInvalidFulfillment
+	}
+
 	var orders []Order
 
 	query := s.client.Collection(s.collection).Query
@@ -44,9 +63,15 @@ func (s *FirestoreService) GetOrders(ctx context.Context, page, pageSize int, se
 		}
 		var order Order
 		doc.DataTo(&order)
+		order.Version = etag.Version(doc.UpdateTime)
+		defaultFulfillment(&order)
+		defaultSubtotal(&order)
+		if fulfillment != "" && order.Fulfillment.Method != fulfillment {
+			continue
+		}
 
 		if search != "" {
-			if strings.Contains(order.Name, search) || strings.Contains(order.Mail, search) {
+			if strings.Contains(order.Name, search) || strings.Contains(order.Mail, search) || (order.Fulfillment.Phone != "" && strings.Contains(order.Fulfillment.Phone, search)) {
 				orders = append(orders, order)
 			}
 		} else {
@@ -88,6 +113,10 @@ func (s *FirestoreService) SearchOrders(ctx context.Context, search string) ([]O
 		}
 		var order Order
 		doc.DataTo(&order)
+		defaultFulfillment(&order)
+		defaultSubtotal(&order)
+		// Anyone can look orders up by name or mail, so the delivery contact details stay private.
+		order.Fulfillment = order.Fulfillment.withoutContact()
 
 		if search != "" {
 			// Search by name, mail, or id
@@ -100,20 +129,34 @@ func (s *FirestoreService) SearchOrders(ctx context.Context, search string) ([]O
 	return orders, nil
 }
 
-func (s *FirestoreService) UpdateOrder(ctx context.Context, id string, data map[string]interface{}) (Order, error) {
+func (s *FirestoreService) UpdateOrder(ctx context.Context, id, version string, data map[string]interface{}) (Order, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Order{}, err
+	}
 	docRef := s.client.Collection(s.collection).Doc(id)
 
 	// Get the original document
 	doc, err := docRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Order{}, ErrOrderNotFound
+	}
 	if err != nil {
 		log.Printf("Failed to get order for update: %v", err)
 		return Order{}, err
 	}
+	if !doc.UpdateTime.Equal(updateTime) {
+		return Order{}, etag.ErrPreconditionFailed
+	}
 	var originalOrder Order
 	doc.DataTo(&originalOrder)
 
 	// Prepare updates
-	var updates []firestore.Update
+	now := time.Now()
+	updates := []firestore.Update{
+		{Path: "updated_at", Value: now},
+		{Path: "updated_by", Value: auth.Actor(ctx)},
+	}
 	for key, value := range data {
 		updates = append(updates, firestore.Update{Path: key, Value: value})
 
@@ -121,7 +164,7 @@ func (s *FirestoreService) UpdateOrder(ctx context.Context, id string, data map[
 		if key == "is_paid" {
 			isPaid, ok := value.(bool)
 			if ok && isPaid && !originalOrder.IsPaid {
-				updates = append(updates, firestore.Update{Path: "paid_at", Value: strconv.FormatInt(time.Now().Unix(), 10)})
+				updates = append(updates, firestore.Update{Path: "paid_at", Value: now})
 			}
 		}
 
@@ -129,19 +172,23 @@ func (s *FirestoreService) UpdateOrder(ctx context.Context, id string, data map[
 		if key == "is_picked" {
 			isPicked, ok := value.(bool)
 			if ok && isPicked && !originalOrder.IsPicked {
-				updates = append(updates, firestore.Update{Path: "picked_at", Value: strconv.FormatInt(time.Now().Unix(), 10)})
+				updates = append(updates, firestore.Update{Path: "picked_at", Value: now})
 			}
 		}
 
 		if (key == "is_enabled") {
 			isEnabled, ok := value.(bool)
 			if ok && !isEnabled {
-				updates = append(updates, firestore.Update{Path: "disabled_at", Value: strconv.FormatInt(time.Now().Unix(), 10)})
+				updates = append(updates, firestore.Update{Path: "disabled_at", Value: now})
 			}
 		}
 	}
 
-	_, err = docRef.Update(ctx, updates)
+	// The precondition also catches a write that lands between the read above and this update.
+	_, err = docRef.Update(ctx, updates, firestore.LastUpdateTime(updateTime))
+	if status.Code(err) == codes.FailedPrecondition {
+		return Order{}, etag.ErrPreconditionFailed
+	}
 	if err != nil {
 		log.Printf("Failed to update order: %v", err)
 		return Order{}, err
@@ -156,31 +203,41 @@ func (s *FirestoreService) UpdateOrder(ctx context.Context, id string, data map[
 
 	var updatedOrder Order
 	updatedDoc.DataTo(&updatedOrder)
+	updatedOrder.Version = etag.Version(updatedDoc.UpdateTime)
 	return updatedOrder, nil
 }
 
 func (s *FirestoreService) CreateOrder(ctx context.Context, req CreateOrderRequest) (Order, error) {
-	ref := s.client.Collection(s.collection).NewDoc()
-
-	totalPrice := 0
-	for _, p := range req.Products {
-		totalPrice += p.Price * p.Count
-	}
-
-	order := Order{
-		ID:         ref.ID,
-		Name:       req.Name,
-		Mail:       req.Mail,
-		Products:   req.Products,
-		TotalPrice: totalPrice,
-		IsEnabled:  true,
-		CreatedAt:  strconv.FormatInt(time.Now().Unix(), 10),
+	quote, err := s.quoteShipping(ctx, req)
+	if err != nil {
+		return Order{}, err
 	}
+	ref := s.client.Collection(s.collection).NewDoc()
+	order := newOrder(ref.ID, req, quote, time.Now(), auth.Actor(ctx))
 
-	_, err := ref.Set(ctx, order)
+	_, err = ref.Set(ctx, order)
 	if err != nil {
 		log.Printf("Failed to create order: %v", err)
 		return Order{}, err
 	}
 	return order, nil
 }
+
+// newOrder builds the order for a create request, with the totals of its shipping quote.
+func newOrder(id string, req CreateOrderRequest, quote shipping.Quote, now time.Time, actor string) Order {
+	return Order{
+		ID:          id,
+		Name:        req.Name,
+		Mail:        req.Mail,
+		Products:    req.Products,
+		Fulfillment: req.Fulfillment,
+		Subtotal:    quote.Subtotal,
+		ShippingFee: quote.ShippingFee,
+		TotalPrice:  quote.Total,
+		IsEnabled:   true,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		CreatedBy:   actor,
+		UpdatedBy:   actor,
+	}
+}
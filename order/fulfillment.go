@@ -0,0 +1,125 @@
+package order
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"suto-e-shop-api/logistics"
+	"suto-e-shop-api/shipping"
+)
+
+// Fulfillment methods, i.e. how the goods reach the customer.
+const (
+	FulfillmentStorePickup      = shipping.MethodStorePickup
+	FulfillmentHomeDelivery     = shipping.MethodHomeDelivery
+	FulfillmentConvenienceStore = shipping.MethodConvenienceStore
+)
+
+// FulfillmentMethods lists every known fulfillment method.
+var FulfillmentMethods = []string{FulfillmentStorePickup, FulfillmentHomeDelivery, FulfillmentConvenienceStore}
+
+// ErrInvalidFulfillment is returned when filtering orders by a fulfillment method that does not exist.
+var ErrInvalidFulfillment = errors.New("invalid fulfillment method, use one of store_pickup, home_delivery, convenience_store")
+
+var (
+	// phonePattern matches Taiwanese landline and mobile numbers once spaces and dashes are removed.
+	phonePattern = regexp.MustCompile(`^0\d{8,9}$`)
+	// mobilePattern matches Taiwanese mobile numbers, which convenience stores text the pickup notice to.
+	mobilePattern = regexp.MustCompile(`^09\d{8}$`)
+	// storeCodePattern matches the store numbers of the convenience-store chains.
+	storeCodePattern = regexp.MustCompile(`^[0-9A-Za-z]{3,10}$`)
+)
+
+// Fulfillment is how an order is handed over and the details that method needs:
+// store pickup takes an optional phone and pickup time, home delivery an address and phone,
+// and convenience-store pickup a store chain and code with the store token, as returned by the store map,
+// and a mobile number. The token is only checked when ordering and is not stored.
+type Fulfillment struct {
+	Method     string     `json:"method" firestore:"method"`
+	Address    string     `json:"address,omitempty" firestore:"address,omitempty"`
+	Phone      string     `json:"phone,omitempty" firestore:"phone,omitempty"`
+	StoreChain string     `json:"store_chain,omitempty" firestore:"store_chain,omitempty"`
+	StoreCode  string     `json:"store_code,omitempty" firestore:"store_code,omitempty"`
+	StoreToken string     `json:"store_token,omitempty" firestore:"-"`
+	PickupAt   *time.Time `json:"pickup_at,omitempty" firestore:"pickup_at,omitempty"`
+}
+
+// validateFulfillment checks the fields of the chosen method and returns them normalized.
+// Orders without a method are store pickups, which is how every order was handled before.
+func validateFulfillment(f Fulfillment, now time.Time) (Fulfillment, error) {
+	f.Address = strings.TrimSpace(f.Address)
+	f.StoreCode = strings.TrimSpace(f.StoreCode)
+	f.Phone = strings.NewReplacer(" ", "", "-", "").Replace(f.Phone)
+	if f.Method == "" {
+		f.Method = FulfillmentStorePickup
+	}
+
+	var allowed []string
+	switch f.Method {
+	case FulfillmentStorePickup:
+		allowed = []string{"phone", "pickup_at"}
+		if f.PickupAt != nil && !f.PickupAt.After(now) {
+			return Fulfillment{}, errors.New("pickup_at must be in the future")
+		}
+	case FulfillmentHomeDelivery:
+		allowed = []string{"address", "phone"}
+		if f.Address == "" {
+			return Fulfillment{}, errors.New("address is required for home delivery")
+		}
+		if f.Phone == "" {
+			return Fulfillment{}, errors.New("phone is required for home delivery")
+		}
+	case FulfillmentConvenienceStore:
+		allowed = []string{"store_chain", "store_code", "store_token", "phone"}
+		if !slices.Contains(logistics.Chains, f.StoreChain) {
+			return Fulfillment{}, errors.New("store_chain is required for convenience-store pickup and must be one of " + strings.Join(logistics.Chains, ", "))
+		}
+		if !storeCodePattern.MatchString(f.StoreCode) {
+			return Fulfillment{}, errors.New("store_code is required for convenience-store pickup and must be 3 to 10 letters or digits")
+		}
+		if !mobilePattern.MatchString(f.Phone) {
+			return Fulfillment{}, errors.New("a mobile phone number like 0912345678 is required for convenience-store pickup")
+		}
+	default:
+		return Fulfillment{}, errors.New("fulfillment method must be one of " + strings.Join(FulfillmentMethods, ", "))
+	}
+
+	if f.Phone != "" && !phonePattern.MatchString(f.Phone) {
+		return Fulfillment{}, errors.New("phone must be a phone number like 0912345678 or 02-12345678")
+	}
+	// Fields of another method are rejected rather than silently stored.
+	fields := []struct {
+		name    string
+		present bool
+	}{
+		{"address", f.Address != ""},
+		{"phone", f.Phone != ""},
+		{"store_chain", f.StoreChain != ""},
+		{"store_code", f.StoreCode != ""},
+		{"store_token", f.StoreToken != ""},
+		{"pickup_at", f.PickupAt != nil},
+	}
+	for _, field := range fields {
+		if field.present && !slices.Contains(allowed, field.name) {
+			return Fulfillment{}, fmt.Errorf("%s is not used for %s", field.name, f.Method)
+		}
+	}
+	return f, nil
+}
+
+// defaultFulfillment marks orders placed before fulfillment methods existed as store pickups.
+func defaultFulfillment(order *Order) {
+	if order.Fulfillment.Method == "" {
+		order.Fulfillment.Method = FulfillmentStorePickup
+	}
+}
+
+// withoutContact drops the address and phone, for order lookups that anyone can make.
+func (f Fulfillment) withoutContact() Fulfillment {
+	f.Address, f.Phone = "", ""
+	return f
+}
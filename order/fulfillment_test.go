@@ -0,0 +1,67 @@
+package order
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateFulfillment(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		in      Fulfillment
+		want    Fulfillment
+		wantErr bool
+	}{
+		{
+			name: "no method is store pickup",
+			in:   Fulfillment{},
+			want: Fulfillment{Method: FulfillmentStorePickup},
+		},
+		{
+			name: "store pickup later",
+			in:   Fulfillment{Method: FulfillmentStorePickup, Phone: "02-1234 5678", PickupAt: &later},
+			want: Fulfillment{Method: FulfillmentStorePickup, Phone: "0212345678", PickupAt: &later},
+		},
+		{"store pickup in the past", Fulfillment{Method: FulfillmentStorePickup, PickupAt: &earlier}, Fulfillment{}, true},
+		{"store pickup now", Fulfillment{Method: FulfillmentStorePickup, PickupAt: &now}, Fulfillment{}, true},
+		{
+			name: "home delivery",
+			in:   Fulfillment{Method: FulfillmentHomeDelivery, Address: " 台北市中正區 ", Phone: "0912-345-678"},
+			want: Fulfillment{Method: FulfillmentHomeDelivery, Address: "台北市中正區", Phone: "0912345678"},
+		},
+		{"home delivery without address", Fulfillment{Method: FulfillmentHomeDelivery, Phone: "0912345678"}, Fulfillment{}, true},
+		{"home delivery without phone", Fulfillment{Method: FulfillmentHomeDelivery, Address: "台北市"}, Fulfillment{}, true},
+		{"home delivery with pickup time", Fulfillment{Method: FulfillmentHomeDelivery, Address: "台北市", Phone: "0912345678", PickupAt: &later}, Fulfillment{}, true},
+		{
+			name: "convenience store",
+			in:   Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "seven_eleven", StoreCode: " 900001 ", StoreToken: "token", Phone: "0912345678"},
+			want: Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "seven_eleven", StoreCode: "900001", StoreToken: "token", Phone: "0912345678"},
+		},
+		{"convenience store unknown chain", Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "hi_life", StoreCode: "900001", Phone: "0912345678"}, Fulfillment{}, true},
+		{"convenience store bad code", Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "seven_eleven", StoreCode: "9-1", Phone: "0912345678"}, Fulfillment{}, true},
+		{"convenience store landline", Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "seven_eleven", StoreCode: "900001", Phone: "0212345678"}, Fulfillment{}, true},
+		{"convenience store with address", Fulfillment{Method: FulfillmentConvenienceStore, StoreChain: "seven_eleven", StoreCode: "900001", Phone: "0912345678", Address: "台北市"}, Fulfillment{}, true},
+		{"store token on store pickup", Fulfillment{Method: FulfillmentStorePickup, StoreToken: "token"}, Fulfillment{}, true},
+		{"bad phone", Fulfillment{Method: FulfillmentStorePickup, Phone: "12345"}, Fulfillment{}, true},
+		{"unknown method", Fulfillment{Method: "drone"}, Fulfillment{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateFulfillment(tt.in, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateFulfillment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Method != tt.want.Method || got.Address != tt.want.Address || got.Phone != tt.want.Phone ||
+				got.StoreChain != tt.want.StoreChain || got.StoreCode != tt.want.StoreCode ||
+				got.StoreToken != tt.want.StoreToken || got.PickupAt != tt.want.PickupAt {
+				t.Errorf("validateFulfillment() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
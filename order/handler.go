@@ -3,20 +3,31 @@ package order
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
 	"suto-e-shop-api/pkg/pagination"
+	"suto-e-shop-api/shipping"
 )
 
 // Handler holds the order service.
 type Handler struct {
 	service Service
+	stores  StoreVerifier
+}
+
+// StoreVerifier checks that a convenience store was chosen on the provider's store map.
+// It is nil when no logistics provider is configured.
+type StoreVerifier interface {
+	VerifyStore(chain, code, token string, now time.Time) error
 }
 
 // NewHandler creates a new order handler.
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service Service, stores StoreVerifier) *Handler {
+	return &Handler{service: service, stores: stores}
 }
 
 // RegisterAdminRoutes registers the admin order routes to the router.
@@ -24,6 +35,7 @@ func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
 	adminRouter := router.PathPrefix("/order").Subrouter()
 	adminRouter.HandleFunc("", h.GetOrders).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.UpdateOrder).Methods("PUT")
+	adminRouter.HandleFunc("/{id}/shipment", h.CreateShipment).Methods("POST")
 }
 
 // RegisterClientRoutes registers the client order routes to the router.
@@ -35,8 +47,13 @@ func (h *Handler) RegisterClientRoutes(router *mux.Router) {
 func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	page, pageSize := pagination.GetPaginationParams(r)
 	search := r.URL.Query().Get("search")
+	fulfillment := r.URL.Query().Get("fulfillment")
 
-	orders, totalCount, err := h.service.GetOrders(r.Context(), page, pageSize, search)
+	orders, totalCount, err := h.service.GetOrders(r.Context(), page, pageSize, search, fulfillment)
+	if errors.Is(err, ErrInvalidFulfillment) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -56,6 +73,12 @@ func (h *Handler) UpdateOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
 	var data map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
@@ -75,15 +98,48 @@ func (h *Handler) UpdateOrder(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	updatedOrder, err := h.service.UpdateOrder(r.Context(), id, data)
-	if err != nil {
+	updatedOrder, err := h.service.UpdateOrder(r.Context(), id, version, data)
+	if errors.Is(err, ErrOrderNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Order not found")
 		return
 	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	etag.SetHeader(w, updatedOrder.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: updatedOrder, Message: "success", Code: 0})
 }
 
+// CreateShipment hands a convenience-store order to the logistics provider for delivery to its store.
+func (h *Handler) CreateShipment(w http.ResponseWriter, r *http.Request) {
+	order, err := h.service.CreateShipment(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrOrderNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if errors.Is(err, ErrNotShippable) || errors.Is(err, ErrLogisticsUnavailable) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrShipmentExists) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, order.Version)
+	RespondWithJSON(w, http.StatusCreated, Response{Data: order, Message: "success", Code: 0})
+}
+
 func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var req CreateOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -91,17 +147,91 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// With an Idempotency-Key a retried request gets the order of the first attempt instead of a new one.
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > MaxIdempotencyKeyLength {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", MaxIdempotencyKeyLength))
+		return
+	}
+	var requestHash string
+	if key != "" {
+		var err error
+		requestHash, err = hashRequest(req)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The retry is answered before validating, which depends on the time of the request.
+		order, found, err := h.service.ReplayOrder(r.Context(), key, requestHash)
+		if errors.Is(err, ErrIdempotencyKeyReused) {
+			RespondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if found {
+			w.Header().Set("Idempotent-Replayed", "true")
+			RespondWithJSON(w, http.StatusCreated, Response{Data: order, Message: "success", Code: 0})
+			return
+		}
+	}
+
 	if err := validateCreateOrderRequest(req); err != nil {
 		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	now := time.Now()
+	fulfillment, err := validateFulfillment(req.Fulfillment, now)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Parcels go to the store the map returned, not to any code the request names.
+	if fulfillment.Method == FulfillmentConvenienceStore {
+		if h.stores == nil {
+			RespondWithError(w, http.StatusBadRequest, ErrLogisticsUnavailable.Error())
+			return
+		}
+		if err := h.stores.VerifyStore(fulfillment.StoreChain, fulfillment.StoreCode, fulfillment.StoreToken, now); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		fulfillment.StoreToken = ""
+	}
+	req.Fulfillment = fulfillment
+
+	if key == "" {
+		order, err := h.service.CreateOrder(r.Context(), req)
+		if errors.Is(err, shipping.ErrMethodUnavailable) {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		RespondWithJSON(w, http.StatusCreated, Response{Data: order, Message: "success", Code: 0})
+		return
+	}
 
-	order, err := h.service.CreateOrder(r.Context(), req)
+	order, replayed, err := h.service.CreateOrderIdempotent(r.Context(), key, requestHash, req)
+	if errors.Is(err, ErrIdempotencyKeyReused) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, shipping.ErrMethodUnavailable) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	RespondWithJSON(w, http.StatusCreated, Response{Data: order, Message: "success", Code: 0})
 }
 
@@ -0,0 +1,162 @@
+package order
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+)
+
+const (
+	// IdempotencyKeyTTL is how long a key keeps returning the order it created.
+	IdempotencyKeyTTL = 24 * time.Hour
+	// MaxIdempotencyKeyLength is the longest Idempotency-Key header accepted.
+	MaxIdempotencyKeyLength = 255
+)
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a different request body.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+// idempotencyRecord remembers the request a key was first used with and the order it created.
+type idempotencyRecord struct {
+	RequestHash string    `firestore:"request_hash"`
+	Order       Order     `firestore:"order"`
+	CreatedAt   time.Time `firestore:"created_at"`
+	ExpiresAt   time.Time `firestore:"expires_at"`
+}
+
+// ReplayOrder returns the order an unexpired key created, with found set. A key first used with
+// another request is rejected. Retries are looked up before the request is validated again, since
+// a pickup time that was in the future on the first attempt may have passed by the retry.
+func (s *FirestoreService) ReplayOrder(ctx context.Context, key, requestHash string) (Order, bool, error) {
+	doc, err := s.client.Collection(s.idempotencyCollection).Doc(hashKey("POST /order", key)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Order{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Failed to get idempotency key: %v", err)
+		return Order{}, false, err
+	}
+	var record idempotencyRecord
+	if err := doc.DataTo(&record); err != nil {
+		return Order{}, false, err
+	}
+	return replay(record, requestHash, time.Now())
+}
+
+// CreateOrderIdempotent creates the order once per key. A retry with the same key and request gets
+// the original order back with replayed set, while the same key with another request is rejected.
+// The key and the order are written in one transaction, so two concurrent retries cannot both create one.
+// requestHash is the hashRequest of the request as the client sent it, before it was normalized.
+func (s *FirestoreService) CreateOrderIdempotent(ctx context.Context, key, requestHash string, req CreateOrderRequest) (Order, bool, error) {
+	// The fee is quoted up front; a replay returns the stored order and ignores it.
+	quote, err := s.quoteShipping(ctx, req)
+	if err != nil {
+		return Order{}, false, err
+	}
+	// Keys are client-chosen, so they are hashed into a valid document ID.
+	keyRef := s.client.Collection(s.idempotencyCollection).Doc(hashKey("POST /order", key))
+
+	var order Order
+	var replayed bool
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		doc, err := tx.Get(keyRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if doc.Exists() {
+			var record idempotencyRecord
+			if err := doc.DataTo(&record); err != nil {
+				return err
+			}
+			order, replayed, err = replay(record, requestHash, now)
+			if err != nil || replayed {
+				return err
+			}
+		}
+
+		ref := s.client.Collection(s.collection).NewDoc()
+		order, replayed = newOrder(ref.ID, req, quote, now, auth.Actor(ctx)), false
+		if err := tx.Create(ref, order); err != nil {
+			return err
+		}
+		return tx.Set(keyRef, idempotencyRecord{
+			RequestHash: requestHash,
+			Order:       order,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(IdempotencyKeyTTL),
+		})
+	})
+	if errors.Is(err, ErrIdempotencyKeyReused) {
+		return Order{}, false, err
+	}
+	if err != nil {
+		log.Printf("Failed to create order: %v", err)
+		return Order{}, false, err
+	}
+	return order, replayed, nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes the keys that expired before the given time.
+func (s *FirestoreService) PurgeExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	iter := s.client.Collection(s.idempotencyCollection).Where("expires_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get idempotency keys: %v", err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge idempotency key %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// replay returns the order stored under an idempotency key, unless the key has expired.
+func replay(record idempotencyRecord, requestHash string, now time.Time) (Order, bool, error) {
+	// An expired key that has not been purged yet is free to use again.
+	if !record.ExpiresAt.After(now) {
+		return Order{}, false, nil
+	}
+	if record.RequestHash != requestHash {
+		return Order{}, false, ErrIdempotencyKeyReused
+	}
+	order := record.Order
+	defaultSubtotal(&order)
+	return order, true, nil
+}
+
+// hashRequest fingerprints the decoded request, so retries that only differ in JSON formatting match.
+func hashRequest(req CreateOrderRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashKey scopes a key to the operation it was sent to.
+func hashKey(operation, key string) string {
+	sum := sha256.Sum256([]byte(operation + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,118 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	stored := Order{ID: "order-1", TotalPrice: 500}
+	record := func(expiresAt time.Time) idempotencyRecord {
+		return idempotencyRecord{RequestHash: "hash", Order: stored, CreatedAt: now.Add(-time.Hour), ExpiresAt: expiresAt}
+	}
+
+	tests := []struct {
+		name         string
+		record       idempotencyRecord
+		requestHash  string
+		wantReplayed bool
+		wantErr      error
+	}{
+		{"same request", record(now.Add(time.Hour)), "hash", true, nil},
+		{"other request", record(now.Add(time.Hour)), "other", false, ErrIdempotencyKeyReused},
+		{"expired key is free again", record(now.Add(-time.Second)), "other", false, nil},
+		{"key expiring now is free again", record(now), "hash", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, replayed, err := replay(tt.record, tt.requestHash, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("replay() error = %v, want %v", err, tt.wantErr)
+			}
+			if replayed != tt.wantReplayed {
+				t.Fatalf("replay() replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if replayed && order.ID != stored.ID {
+				t.Errorf("replay() order = %+v, want %+v", order, stored)
+			}
+		})
+	}
+
+	// Orders stored before shipping fees existed come back with their total as the subtotal.
+	order, _, _ := replay(record(now.Add(time.Hour)), "hash", now)
+	if order.Subtotal != 500 {
+		t.Errorf("replay() subtotal = %d, want 500", order.Subtotal)
+	}
+}
+
+func TestHashRequest(t *testing.T) {
+	decode := func(body string) CreateOrderRequest {
+		var req CreateOrderRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("decode %s: %v", body, err)
+		}
+		return req
+	}
+	hash := func(req CreateOrderRequest) string {
+		h, err := hashRequest(req)
+		if err != nil {
+			t.Fatalf("hashRequest() error = %v", err)
+		}
+		return h
+	}
+
+	compact := decode(`{"mail":"a@example.com","name":"A","products":[{"name":"Tea","count":1,"price":300}],"fulfillment":{"method":"store_pickup"}}`)
+	reformatted := decode(`{
+		"fulfillment": {"method": "store_pickup"},
+		"products": [{"price": 300, "count": 1, "name": "Tea"}],
+		"name": "A",
+		"mail": "a@example.com"
+	}`)
+	if hash(compact) != hash(reformatted) {
+		t.Error("hashRequest() differs for the same request formatted differently")
+	}
+
+	changed := decode(`{"mail":"a@example.com","name":"A","products":[{"name":"Tea","count":2,"price":300}],"fulfillment":{"method":"store_pickup"}}`)
+	if hash(compact) == hash(changed) {
+		t.Error("hashRequest() is the same for requests with different counts")
+	}
+}
+
+// replayService has a stored order for every key; the other operations are not used.
+type replayService struct {
+	Service
+	order Order
+}
+
+func (s replayService) ReplayOrder(ctx context.Context, key, requestHash string) (Order, bool, error) {
+	return s.order, true, nil
+}
+
+func TestCreateOrderReplaysBeforeValidating(t *testing.T) {
+	handler := NewHandler(replayService{order: Order{ID: "order-1"}}, nil)
+	// The pickup time was in the future when the order was placed, but has passed by the retry.
+	body := `{"mail":"a@example.com","name":"A","products":[{"name":"Tea","count":1,"price":300}],
+		"fulfillment":{"method":"store_pickup","pickup_at":"2020-01-01T10:00:00Z"}}`
+	r := httptest.NewRequest("POST", "/order", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", "retry-1")
+	w := httptest.NewRecorder()
+
+	handler.CreateOrder(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Idempotent-Replayed header is not set")
+	}
+	if !strings.Contains(w.Body.String(), `"order-1"`) {
+		t.Errorf("body = %s, want the stored order", w.Body)
+	}
+}
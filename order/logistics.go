@@ -0,0 +1,164 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/logistics"
+	"suto-e-shop-api/pkg/etag"
+)
+
+var (
+	// ErrNotShippable is returned when creating a shipment for an order that is not an enabled
+	// convenience-store pickup.
+	ErrNotShippable = errors.New("only enabled convenience-store orders can be shipped")
+	// ErrShipmentExists is returned when creating a shipment for an order that already has one.
+	ErrShipmentExists = errors.New("order already has a shipment")
+	// ErrLogisticsUnavailable is returned for convenience-store pickup when no logistics provider is configured.
+	ErrLogisticsUnavailable = errors.New("convenience-store pickup is not available")
+)
+
+// CreateShipment registers the order's parcel with the logistics provider and stores its tracking number.
+func (s *FirestoreService) CreateShipment(ctx context.Context, id string) (Order, error) {
+	if s.logistics == nil {
+		return Order{}, ErrLogisticsUnavailable
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
+	doc, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to get order for shipment: %v", err)
+		return Order{}, err
+	}
+	var order Order
+	if err := doc.DataTo(&order); err != nil {
+		return Order{}, err
+	}
+	defaultFulfillment(&order)
+	if order.Shipment != nil {
+		return Order{}, ErrShipmentExists
+	}
+	if !order.IsEnabled || order.Fulfillment.Method != FulfillmentConvenienceStore {
+		return Order{}, ErrNotShippable
+	}
+	// Orders placed before store chains were recorded cannot be routed to a carrier.
+	if !slices.Contains(logistics.Chains, order.Fulfillment.StoreChain) {
+		return Order{}, fmt.Errorf("%w: the order has no store chain", ErrNotShippable)
+	}
+
+	shipment, err := s.logistics.CreateShipment(ctx, logistics.ShipmentRequest{
+		OrderID:       order.ID,
+		ReceiverName:  order.Name,
+		ReceiverPhone: order.Fulfillment.Phone,
+		StoreChain:    order.Fulfillment.StoreChain,
+		StoreCode:     order.Fulfillment.StoreCode,
+		Amount:        order.TotalPrice,
+	})
+	if err != nil {
+		log.Printf("Failed to create shipment for order %s: %v", id, err)
+		return Order{}, err
+	}
+
+	// Only the shipment is written, so edits made while the provider was called are kept.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var current Order
+		if err := doc.DataTo(&current); err != nil {
+			return err
+		}
+		if current.Shipment != nil {
+			return ErrShipmentExists
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "shipment", Value: shipment},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if err != nil {
+		// The parcel is registered with the provider either way, so keep its number for reconciling.
+		log.Printf("Failed to save shipment %s for order %s: %v", shipment.TrackingNumber, id, err)
+		return Order{}, err
+	}
+
+	updatedDoc, err := ref.Get(ctx)
+	if err != nil {
+		log.Printf("Failed to get shipped order: %v", err)
+		return Order{}, err
+	}
+	var updatedOrder Order
+	updatedDoc.DataTo(&updatedOrder)
+	defaultFulfillment(&updatedOrder)
+	defaultSubtotal(&updatedOrder)
+	updatedOrder.Version = etag.Version(updatedDoc.UpdateTime)
+	return updatedOrder, nil
+}
+
+// UpdateShipmentStatus applies a provider's status update to the order with that tracking number.
+// A picked-up parcel also marks the order as picked.
+func (s *FirestoreService) UpdateShipmentStatus(ctx context.Context, update logistics.StatusUpdate) error {
+	docs, err := s.client.Collection(s.collection).
+		Where("shipment.tracking_number", "==", update.TrackingNumber).
+		Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to find order for shipment: %v", err)
+		return err
+	}
+	if len(docs) == 0 {
+		return logistics.ErrShipmentNotFound
+	}
+	ref := docs[0].Ref
+
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var order Order
+		if err := doc.DataTo(&order); err != nil {
+			return err
+		}
+		if order.Shipment == nil || order.Shipment.Provider != update.Provider {
+			return logistics.ErrShipmentNotFound
+		}
+		// Webhooks can be retried or arrive out of order, so older updates are ignored.
+		if update.At.Before(order.Shipment.StatusAt) {
+			return nil
+		}
+
+		updates := []firestore.Update{
+			{Path: "shipment.status", Value: update.Status},
+			{Path: "shipment.status_at", Value: update.At},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: "logistics:" + update.Provider},
+		}
+		if update.Status == logistics.StatusPickedUp && !order.IsPicked {
+			updates = append(updates,
+				firestore.Update{Path: "is_picked", Value: true},
+				firestore.Update{Path: "picked_at", Value: update.At},
+			)
+		}
+		return tx.Update(ref, updates)
+	})
+	if errors.Is(err, logistics.ErrShipmentNotFound) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to update shipment status: %v", err)
+		return err
+	}
+	return nil
+}
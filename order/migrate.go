@@ -0,0 +1,79 @@
+package order
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// legacyTimestampFields are the order fields that used to be stored as unix-second strings.
+var legacyTimestampFields = []string{"created_at", "paid_at", "picked_at", "disabled_at"}
+
+// MigrateTimestamps converts order timestamps stored as unix-second strings into Firestore timestamps.
+// Documents that are already converted are skipped, so it is safe to run more than once.
+func (s *FirestoreService) MigrateTimestamps(ctx context.Context) (int, error) {
+	iter := s.client.Collection(s.collection).Documents(ctx)
+	defer iter.Stop()
+
+	migrated := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to read orders for migration: %v", err)
+			return migrated, err
+		}
+
+		updates := legacyTimestampUpdates(doc.Ref.ID, doc.Data())
+		if len(updates) == 0 {
+			continue
+		}
+		if _, err := doc.Ref.Update(ctx, updates, firestore.LastUpdateTime(doc.UpdateTime)); err != nil {
+			log.Printf("Failed to migrate order %s: %v", doc.Ref.ID, err)
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// legacyTimestampUpdates builds the updates that turn string timestamps into time values.
+// Empty strings become null, and orders without updated_at inherit their creation time.
+func legacyTimestampUpdates(id string, data map[string]interface{}) []firestore.Update {
+	var updates []firestore.Update
+	var createdAt interface{} = data["created_at"]
+
+	for _, field := range legacyTimestampFields {
+		raw, ok := data[field].(string)
+		if !ok {
+			continue
+		}
+
+		var value interface{}
+		if raw != "" {
+			seconds, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				log.Printf("Skipping order %s: %s is not a unix timestamp: %q", id, field, raw)
+				continue
+			}
+			value = time.Unix(seconds, 0)
+		}
+		updates = append(updates, firestore.Update{Path: field, Value: value})
+		if field == "created_at" {
+			createdAt = value
+		}
+	}
+
+	if _, ok := data["updated_at"]; !ok {
+		if _, ok := createdAt.(time.Time); ok {
+			updates = append(updates, firestore.Update{Path: "updated_at", Value: createdAt})
+		}
+	}
+	return updates
+}
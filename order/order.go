@@ -2,41 +2,60 @@ package order
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	"suto-e-shop-api/logistics"
 )
 
+// ErrOrderNotFound is returned when the requested order does not exist.
+var ErrOrderNotFound = errors.New("order not found")
+
 type Product struct {
 	Name  string `json:"name" firestore:"name"`
 	Count int    `json:"count" firestore:"count"`
 	Price int    `json:"price" firestore:"price"`
 }
 
-// Order defines the order data structure.
+// Order defines the order data structure. TotalPrice is Subtotal, the sum of the products, plus ShippingFee.
 type Order struct {
-	ID         string    `json:"id" firestore:"id"`
-	Products   []Product `json:"products" firestore:"products"`
-	Name       string    `json:"name" firestore:"name"`
-	Mail       string    `json:"mail" firestore:"mail"`
-	Note       string    `json:"note" firestore:"note"`
-	TotalPrice int       `json:"total_price" firestore:"total_price"`
-	IsPaid     bool      `json:"is_paid" firestore:"is_paid"`
-	IsPicked   bool      `json:"is_picked" firestore:"is_picked"`
-	IsEnabled  bool      `json:"is_enabled" firestore:"is_enabled"`
-	PaidAt     string    `json:"paid_at" firestore:"paid_at"`
-	PickedAt   string    `json:"picked_at" firestore:"picked_at"`
-	CreatedAt  string    `json:"created_at" firestore:"created_at"`
-	DisabledAt string    `json:"disabled_at" firestore:"disabled_at"`
+	ID          string              `json:"id" firestore:"id"`
+	Products    []Product           `json:"products" firestore:"products"`
+	Name        string              `json:"name" firestore:"name"`
+	Mail        string              `json:"mail" firestore:"mail"`
+	Note        string              `json:"note" firestore:"note"`
+	Fulfillment Fulfillment         `json:"fulfillment" firestore:"fulfillment"`
+	Subtotal    int                 `json:"subtotal" firestore:"subtotal"`
+	ShippingFee int                 `json:"shipping_fee" firestore:"shipping_fee"`
+	TotalPrice  int                 `json:"total_price" firestore:"total_price"`
+	IsPaid      bool                `json:"is_paid" firestore:"is_paid"`
+	IsPicked    bool                `json:"is_picked" firestore:"is_picked"`
+	IsEnabled   bool                `json:"is_enabled" firestore:"is_enabled"`
+	Shipment    *logistics.Shipment `json:"shipment,omitempty" firestore:"shipment,omitempty"`
+	PaidAt      *time.Time          `json:"paid_at" firestore:"paid_at"`
+	PickedAt    *time.Time          `json:"picked_at" firestore:"picked_at"`
+	CreatedAt   time.Time           `json:"created_at" firestore:"created_at"`
+	DisabledAt  *time.Time          `json:"disabled_at" firestore:"disabled_at"`
+	UpdatedAt   time.Time           `json:"updated_at" firestore:"updated_at"`
+	CreatedBy   string              `json:"created_by" firestore:"created_by"`
+	UpdatedBy   string              `json:"updated_by" firestore:"updated_by"`
+	Version     string              `json:"version,omitempty" firestore:"-"`
 }
 
 type CreateOrderRequest struct {
-	Mail     string    `json:"mail"`
-	Name     string    `json:"name"`
-	Products []Product `json:"products"`
+	Mail        string      `json:"mail"`
+	Name        string      `json:"name"`
+	Products    []Product   `json:"products"`
+	Fulfillment Fulfillment `json:"fulfillment"`
 }
 
 // Service provides order operations.
 type Service interface {
-	GetOrders(ctx context.Context, page, pageSize int, search string) ([]Order, int, error)
+	GetOrders(ctx context.Context, page, pageSize int, search, fulfillment string) ([]Order, int, error)
 	SearchOrders(ctx context.Context, search string) ([]Order, error)
-	UpdateOrder(ctx context.Context, id string, data map[string]interface{}) (Order, error)
+	UpdateOrder(ctx context.Context, id, version string, data map[string]interface{}) (Order, error)
 	CreateOrder(ctx context.Context, req CreateOrderRequest) (Order, error)
+	ReplayOrder(ctx context.Context, key, requestHash string) (Order, bool, error)
+	CreateOrderIdempotent(ctx context.Context, key, requestHash string, req CreateOrderRequest) (Order, bool, error)
+	CreateShipment(ctx context.Context, id string) (Order, error)
 }
@@ -0,0 +1,32 @@
+package order
+
+import (
+	"context"
+
+	"suto-e-shop-api/shipping"
+)
+
+// ShippingQuoter prices the shipping of an order.
+type ShippingQuoter interface {
+	Quote(ctx context.Context, req shipping.QuoteRequest) (shipping.Quote, error)
+}
+
+// quoteShipping prices the shipping of a create request.
+func (s *FirestoreService) quoteShipping(ctx context.Context, req CreateOrderRequest) (shipping.Quote, error) {
+	items := make([]shipping.Item, len(req.Products))
+	for i, p := range req.Products {
+		items[i] = shipping.Item{Count: p.Count, Price: p.Price}
+	}
+	return s.shipping.Quote(ctx, shipping.QuoteRequest{
+		Method:  req.Fulfillment.Method,
+		Address: req.Fulfillment.Address,
+		Items:   items,
+	})
+}
+
+// defaultSubtotal fills the subtotal of orders placed before shipping fees existed, which was their total.
+func defaultSubtotal(order *Order) {
+	if order.Subtotal == 0 && order.ShippingFee == 0 {
+		order.Subtotal = order.TotalPrice
+	}
+}
@@ -0,0 +1,59 @@
+package etag
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPreconditionRequired is returned when an update is sent without an If-Match header.
+	ErrPreconditionRequired = errors.New("If-Match header is required")
+	// ErrPreconditionFailed is returned when the document changed since the client read it.
+	ErrPreconditionFailed = errors.New("the resource has been modified, please reload and try again")
+)
+
+// Version turns a document update time into the opaque version string exposed to clients.
+func Version(updateTime time.Time) string {
+	if updateTime.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(updateTime.UnixNano(), 10)
+}
+
+// Time parses a version produced by Version back into the document update time.
+// A version that cannot be parsed can never match, so it is reported as a failed precondition.
+func Time(version string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrPreconditionFailed
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// IfMatch returns the version carried by the request's If-Match header.
+func IfMatch(r *http.Request) (string, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" {
+		return "", ErrPreconditionRequired
+	}
+	value = strings.TrimPrefix(value, "W/")
+	return strings.Trim(value, `"`), nil
+}
+
+// SetHeader writes the ETag header for the given version.
+func SetHeader(w http.ResponseWriter, version string) {
+	if version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+	}
+}
+
+// StatusCode maps a precondition error to its HTTP status code.
+func StatusCode(err error) int {
+	if errors.Is(err, ErrPreconditionRequired) {
+		return http.StatusPreconditionRequired
+	}
+	return http.StatusPreconditionFailed
+}
@@ -0,0 +1,154 @@
+package patch
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule validates a single field of a partial update and returns the value to store.
+type Rule func(value interface{}) (interface{}, error)
+
+// Validate checks every field in data against its rule and returns the normalized values.
+// Fields without a rule are rejected so a client cannot write arbitrary paths.
+func Validate(data map[string]interface{}, rules map[string]Rule) (map[string]interface{}, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no fields to update")
+	}
+
+	// Sort keys so the first reported error is stable.
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make(map[string]interface{}, len(data))
+	for _, key := range keys {
+		rule, ok := rules[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid field in request payload: %s", key)
+		}
+		value, err := rule(data[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s %v", key, err)
+		}
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// String accepts any string value.
+func String() Rule {
+	return func(value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		return s, nil
+	}
+}
+
+// RequiredString accepts a string that is not blank.
+func RequiredString() Rule {
+	return func(value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if strings.TrimSpace(s) == "" {
+			return nil, fmt.Errorf("is required")
+		}
+		return s, nil
+	}
+}
+
+// OneOf accepts one of the given strings.
+func OneOf(values ...string) Rule {
+	return func(value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok || !slices.Contains(values, s) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+		}
+		return s, nil
+	}
+}
+
+// Strings accepts a list of strings.
+func Strings() Rule {
+	return func(value interface{}) (interface{}, error) {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("must be a list of strings")
+		}
+		strs := make([]string, len(list))
+		for i, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a list of strings")
+			}
+			strs[i] = s
+		}
+		return strs, nil
+	}
+}
+
+// Bool accepts a boolean value.
+func Bool() Rule {
+	return func(value interface{}) (interface{}, error) {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return b, nil
+	}
+}
+
+// Int accepts a whole number between min and max inclusive and stores it as int64.
+func Int(min, max int64) Rule {
+	return func(value interface{}) (interface{}, error) {
+		f, ok := value.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		if f < float64(min) || f > float64(max) {
+			return nil, fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return int64(f), nil
+	}
+}
+
+// Float accepts a number between min and max inclusive.
+func Float(min, max float64) Rule {
+	return func(value interface{}) (interface{}, error) {
+		f, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		if f < min || f > max {
+			return nil, fmt.Errorf("must be between %g and %g", min, max)
+		}
+		return f, nil
+	}
+}
+
+// Time accepts an RFC 3339 timestamp, or null to clear the field.
+func Time() Rule {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an RFC 3339 timestamp or null")
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("must be an RFC 3339 timestamp or null")
+		}
+		return t, nil
+	}
+}
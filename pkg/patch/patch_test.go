@@ -0,0 +1,86 @@
+package patch
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	rules := map[string]Rule{
+		"name":   RequiredString(),
+		"active": Bool(),
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{"no fields", map[string]interface{}{}, nil, "no fields to update"},
+		{"known fields", map[string]interface{}{"name": "Tea", "active": true}, map[string]interface{}{"name": "Tea", "active": true}, ""},
+		{"unknown field", map[string]interface{}{"name": "Tea", "created_by": "me"}, nil, "invalid field in request payload: created_by"},
+		{"first error by key", map[string]interface{}{"name": "", "active": "yes"}, nil, "active must be a boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Validate(tt.data, rules)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		rule    Rule
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"string", String(), "", "", false},
+		{"string not a string", String(), 1.0, nil, true},
+		{"required string", RequiredString(), "Tea", "Tea", false},
+		{"required string blank", RequiredString(), "  ", nil, true},
+		{"one of", OneOf("a", "b"), "b", "b", false},
+		{"one of other", OneOf("a", "b"), "c", nil, true},
+		{"strings", Strings(), []interface{}{"a", "b"}, []string{"a", "b"}, false},
+		{"strings empty", Strings(), []interface{}{}, []string{}, false},
+		{"strings mixed", Strings(), []interface{}{"a", 1.0}, nil, true},
+		{"bool", Bool(), false, false, false},
+		{"bool as string", Bool(), "true", nil, true},
+		{"int", Int(0, 10), 10.0, int64(10), false},
+		{"int fraction", Int(0, 10), 1.5, nil, true},
+		{"int out of range", Int(0, 10), 11.0, nil, true},
+		{"float", Float(0, 5), 4.5, 4.5, false},
+		{"float out of range", Float(0, 5), -0.1, nil, true},
+		{"time", Time(), "2024-06-01T12:00:00Z", at, false},
+		{"time null clears", Time(), nil, nil, false},
+		{"time not RFC 3339", Time(), "2024-06-01", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rule error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rule = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
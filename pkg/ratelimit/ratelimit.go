@@ -0,0 +1,200 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limit is a token bucket that holds up to Burst requests and refills Requests tokens every Per.
+// A zero Burst is the same as Requests.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// rate returns the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// capacity returns the size of the bucket.
+func (l Limit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// Store keeps the token buckets. MemoryStore is enough for a single instance; running several
+// instances behind a load balancer needs a shared implementation, e.g. on Redis, so they count together.
+type Store interface {
+	// Take removes a token from the bucket of key. When the bucket is empty it reports how long
+	// until the next token is available.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// Limiter throttles requests per client IP and route.
+type Limiter struct {
+	store          Store
+	trustedProxies []netip.Prefix
+	now            func() time.Time
+}
+
+// New creates a limiter. X-Forwarded-For is only read when the request comes from one of trustedProxies.
+func New(store Store, trustedProxies []netip.Prefix) *Limiter {
+	return &Limiter{store: store, trustedProxies: trustedProxies, now: time.Now}
+}
+
+// Middleware limits the routes in limits, keyed by method and path template like "POST /order".
+// Other routes pass through. A failing store lets requests through rather than taking the shop down.
+func (l *Limiter) Middleware(limits map[string]Limit) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeKey(r)
+			limit, ok := limits[route]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, retryAfter, err := l.store.Take(r.Context(), route+"|"+l.ClientIP(r).String(), limit, l.now())
+			if err != nil {
+				log.Printf("Rate limit store failed: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]interface{}{"message": "Too many requests", "code": http.StatusTooManyRequests})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeKey names the matched route, e.g. "POST /order", or returns "" when there is none.
+func routeKey(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return r.Method + " " + template
+}
+
+// ClientIP returns the address of the client. Behind trusted proxies it is the rightmost
+// X-Forwarded-For entry that is not a trusted proxy itself; anything further left could be forged.
+func (l *Limiter) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && l.trusted(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr
+}
+
+func (l *Limiter) trusted(addr netip.Addr) bool {
+	for _, prefix := range l.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses a comma-separated list of IP addresses and CIDR ranges, e.g. "10.0.0.0/8, 127.0.0.1".
+func ParsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ParseLimits parses per-route limits like "POST /order=5/1m, GET /order=30/1m:60", where each
+// entry is requests per duration with an optional burst after the colon.
+func ParseLimits(value string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected METHOD /path=requests/duration", item)
+		}
+		spec, burst, hasBurst := strings.Cut(spec, ":")
+		requests, per, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected METHOD /path=requests/duration", item)
+		}
+
+		var limit Limit
+		var err error
+		if limit.Requests, err = strconv.Atoi(requests); err != nil || limit.Requests <= 0 {
+			return nil, fmt.Errorf("invalid request count in rate limit %q", item)
+		}
+		if limit.Per, err = time.ParseDuration(per); err != nil || limit.Per <= 0 {
+			return nil, fmt.Errorf("invalid duration in rate limit %q", item)
+		}
+		if hasBurst {
+			if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+				return nil, fmt.Errorf("invalid burst in rate limit %q", item)
+			}
+		}
+		limits[strings.Join(strings.Fields(route), " ")] = limit
+	}
+	return limits, nil
+}
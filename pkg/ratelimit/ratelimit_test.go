@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	limiter := New(NewMemoryStore(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("127.0.0.1/32"),
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forged entries on the left", "10.0.0.2:1234", []string{"192.0.2.99, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "127.0.0.1:1234", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"header split across lines", "10.0.0.2:1234", []string{"192.0.2.99", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage hop stops the walk", "10.0.0.2:1234", []string{"198.51.100.1, nonsense"}, "10.0.0.2"},
+		{"mapped IPv4", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+		{"no port", "203.0.113.7", nil, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := limiter.ClientIP(r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]Limit
+		wantErr bool
+	}{
+		{"empty", "", map[string]Limit{}, false},
+		{
+			name:  "several routes",
+			value: "POST /order=5/1m, GET  /order=30/1m:60",
+			want: map[string]Limit{
+				"POST /order": {Requests: 5, Per: time.Minute},
+				"GET /order":  {Requests: 30, Per: time.Minute, Burst: 60},
+			},
+		},
+		{"trailing comma", "POST /order=5/1m,", map[string]Limit{"POST /order": {Requests: 5, Per: time.Minute}}, false},
+		{"missing equals", "POST /order 5/1m", nil, true},
+		{"missing duration", "POST /order=5", nil, true},
+		{"zero requests", "POST /order=0/1m", nil, true},
+		{"bad duration", "POST /order=5/minute", nil, true},
+		{"zero duration", "POST /order=5/0s", nil, true},
+		{"bad burst", "POST /order=5/1m:x", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLimits(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Every runs job in the background once right away and then once per interval until ctx is cancelled.
+// Failures are logged and the job is retried on the next tick.
+func Every(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := job(ctx); err != nil {
+				log.Printf("Scheduled job %q failed: %v", name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -2,10 +2,17 @@ package product
 
 import (
 	"context"
+	"errors"
 	"log"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
 )
 
 // FirestoreService is a Firestore implementation of the product service.
@@ -25,11 +32,15 @@ func NewFirestoreService(client *firestore.Client) *FirestoreService {
 func (s *FirestoreService) AdminCreateProduct(ctx context.Context, product Product) (Product, error) {
 	ref := s.client.Collection(s.collection).NewDoc()
 	product.ID = ref.ID
-	_, err := ref.Set(ctx, product)
+	now, actor := time.Now(), auth.Actor(ctx)
+	product.CreatedAt, product.UpdatedAt = now, now
+	product.CreatedBy, product.UpdatedBy = actor, actor
+	wr, err := ref.Set(ctx, product)
 	if err != nil {
 		log.Printf("Failed to create product: %v", err)
 		return Product{}, err
 	}
+	product.Version = etag.Version(wr.UpdateTime)
 	return product, nil
 }
 
@@ -53,6 +64,10 @@ func (s *FirestoreService) AdminGetProducts(ctx context.Context, page, pageSize
 		}
 		var product Product
 		doc.DataTo(&product)
+		if product.DeletedAt != nil {
+			continue
+		}
+		product.Version = etag.Version(doc.UpdateTime)
 		products = append(products, product)
 	}
 
@@ -79,21 +94,118 @@ func (s *FirestoreService) AdminGetProduct(ctx context.Context, id string) (Prod
 	}
 	var product Product
 	doc.DataTo(&product)
+	product.Version = etag.Version(doc.UpdateTime)
 	return product, nil
 }
 
-func (s *FirestoreService) AdminUpdateProduct(ctx context.Context, id string, product Product) (Product, error) {
-	_, err := s.client.Collection(s.collection).Doc(id).Set(ctx, product)
+func (s *FirestoreService) AdminUpdateProduct(ctx context.Context, id, version string, product Product) (Product, error) {
+	updateTime, err := etag.Time(version)
 	if err != nil {
-		log.Printf("Failed to update product: %v", err)
 		return Product{}, err
 	}
+	ref := s.client.Collection(s.collection).Doc(id)
 	product.ID = id
-	return product, nil
+
+	// PUT replaces the whole document, but only if it exists and has not changed since it was read.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+
+		// Creation stamps always come from the stored document, never from the request.
+		var existing Product
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrProductNotFound
+		}
+		product.CreatedAt, product.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		product.DeletedAt, product.DeletedBy = nil, ""
+		product.UpdatedAt, product.UpdatedBy = time.Now(), auth.Actor(ctx)
+		return tx.Set(ref, product)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrProductNotFound) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to update product: %v", err)
+		return Product{}, err
+	}
+	return s.AdminGetProduct(ctx, id)
+}
+
+func (s *FirestoreService) AdminPatchProduct(ctx context.Context, id, version string, fields map[string]interface{}) (Product, error) {
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Product{}, err
+	}
+	ref := s.client.Collection(s.collection).Doc(id)
+
+	updates := []firestore.Update{
+		{Path: "updated_at", Value: time.Now()},
+		{Path: "updated_by", Value: auth.Actor(ctx)},
+	}
+	for key, value := range fields {
+		updates = append(updates, firestore.Update{Path: key, Value: value})
+	}
+
+	// Update only touches the given paths; like PUT it needs the document to be unchanged and not in the trash.
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+		var existing Product
+		if err := doc.DataTo(&existing); err != nil {
+			return err
+		}
+		if existing.DeletedAt != nil {
+			return ErrProductNotFound
+		}
+		return tx.Update(ref, updates)
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrProductNotFound) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to patch product: %v", err)
+		return Product{}, err
+	}
+
+	return s.AdminGetProduct(ctx, id)
 }
 
+// AdminDeleteProduct moves the product to the trash; PurgeDeletedProducts removes it for good.
 func (s *FirestoreService) AdminDeleteProduct(ctx context.Context, id string) error {
-	_, err := s.client.Collection(s.collection).Doc(id).Delete(ctx)
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var product Product
+		if err := doc.DataTo(&product); err != nil {
+			return err
+		}
+		if product.DeletedAt != nil {
+			return ErrProductNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: time.Now()},
+			{Path: "deleted_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrProductNotFound) {
+		return ErrProductNotFound
+	}
 	if err != nil {
 		log.Printf("Failed to delete product: %v", err)
 		return err
@@ -101,7 +213,99 @@ func (s *FirestoreService) AdminDeleteProduct(ctx context.Context, id string) er
 	return nil
 }
 
-func (s *FirestoreService) GetProducts(ctx context.Context, page, pageSize int, search string) ([]ProductSimple, int, error) {
+func (s *FirestoreService) AdminGetDeletedProducts(ctx context.Context, page, pageSize int) ([]Product, int, error) {
+	var products []Product
+	query := s.client.Collection(s.collection).Where("deleted_at", "!=", nil).OrderBy("deleted_at", firestore.Desc)
+
+	iter := query.Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted products: %v", err)
+			return nil, 0, err
+		}
+		var product Product
+		doc.DataTo(&product)
+		product.Version = etag.Version(doc.UpdateTime)
+		products = append(products, product)
+	}
+
+	totalCount := len(products)
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Product{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	return products[start:end], totalCount, nil
+}
+
+func (s *FirestoreService) AdminRestoreProduct(ctx context.Context, id string) (Product, error) {
+	ref := s.client.Collection(s.collection).Doc(id)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var product Product
+		if err := doc.DataTo(&product); err != nil {
+			return err
+		}
+		if product.DeletedAt == nil {
+			return ErrProductNotFound
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "deleted_at", Value: nil},
+			{Path: "deleted_by", Value: firestore.Delete},
+			{Path: "updated_at", Value: time.Now()},
+			{Path: "updated_by", Value: auth.Actor(ctx)},
+		})
+	})
+	if status.Code(err) == codes.NotFound || errors.Is(err, ErrProductNotFound) {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to restore product: %v", err)
+		return Product{}, err
+	}
+	return s.AdminGetProduct(ctx, id)
+}
+
+// PurgeDeletedProducts permanently removes products that were moved to the trash before the given time.
+func (s *FirestoreService) PurgeDeletedProducts(ctx context.Context, before time.Time) (int, error) {
+	iter := s.client.Collection(s.collection).Where("deleted_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get deleted products: %v", err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge product %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// GetProducts lists products outside the trash. enabledOnly also leaves out disabled products, as the
+// category landing page does; the /products listing keeps showing them.
+func (s *FirestoreService) GetProducts(ctx context.Context, page, pageSize int, search string, categoryIDs []string, sortBy string, enabledOnly bool) ([]ProductSimple, int, error) {
 	var products []ProductSimple
 	// For more advanced search capabilities, consider using a dedicated search service like Algolia or Elasticsearch.
 	query := s.client.Collection(s.collection).Query
@@ -121,9 +325,17 @@ func (s *FirestoreService) GetProducts(ctx context.Context, page, pageSize int,
 		}
 		var product ProductSimple
 		doc.DataTo(&product)
+		if product.DeletedAt != nil || (enabledOnly && !product.IsEnabled) || !inCategories(product.CategoryID, categoryIDs) {
+			continue
+		}
 		products = append(products, product)
 	}
 
+	// Sorted in memory like the rest of the listing, so no composite index is needed per sort option.
+	if err := sortProducts(products, sortBy); err != nil {
+		return nil, 0, err
+	}
+
 	totalCount := len(products)
 	start := (page - 1) * pageSize
 	end := start + pageSize
@@ -139,17 +351,60 @@ func (s *FirestoreService) GetProducts(ctx context.Context, page, pageSize int,
 	return products[start:end], totalCount, nil
 }
 
-func (s *FirestoreService) GetProductsIds(ctx context.Context, ids []string) ([]Product, error) {
-	var products []Product
+func (s *FirestoreService) GetProductsIds(ctx context.Context, ids []string) (ProductsIdsResult, error) {
+	ids = uniqueIds(ids)
+	if len(ids) > MaxProductsIds {
+		return ProductsIdsResult{}, ErrTooManyIds
+	}
+
+	result := newProductsIdsResult(len(ids))
+	var refs []*firestore.DocumentRef
 	for _, id := range ids {
-		product, err := s.GetProduct(ctx, id)
-		if err != nil {
-			log.Printf("Failed to get product: %v", err)
+		// An empty or slash-containing ID is not a valid document name.
+		if id == "" || strings.Contains(id, "/") {
 			continue
 		}
-		products = append(products, product)
+		refs = append(refs, s.client.Collection(s.collection).Doc(id))
 	}
-	return products, nil
+	if len(refs) == 0 {
+		result.MissingIDs = append(result.MissingIDs, ids...)
+		return result, nil
+	}
+
+	// GetAll returns the snapshots in the same order as refs.
+	docs, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		log.Printf("Failed to get products: %v", err)
+		return ProductsIdsResult{}, err
+	}
+	byID := make(map[string]*firestore.DocumentSnapshot, len(docs))
+	for _, doc := range docs {
+		byID[doc.Ref.ID] = doc
+	}
+
+	for _, id := range ids {
+		doc, ok := byID[id]
+		if !ok || !doc.Exists() {
+			result.MissingIDs = append(result.MissingIDs, id)
+			continue
+		}
+		var product Product
+		if err := doc.DataTo(&product); err != nil {
+			log.Printf("Failed to decode product %s: %v", id, err)
+			result.MissingIDs = append(result.MissingIDs, id)
+			continue
+		}
+		if product.DeletedAt != nil {
+			result.MissingIDs = append(result.MissingIDs, id)
+			continue
+		}
+		if !product.IsEnabled {
+			result.DisabledIDs = append(result.DisabledIDs, id)
+			continue
+		}
+		result.Products = append(result.Products, product.public())
+	}
+	return result, nil
 }
 
 func (s *FirestoreService) GetProduct(ctx context.Context, id string) (Product, error) {
@@ -160,12 +415,15 @@ func (s *FirestoreService) GetProduct(ctx context.Context, id string) (Product,
 	}
 	var product Product
 	doc.DataTo(&product)
-	return product, nil
+	if product.DeletedAt != nil {
+		return Product{}, ErrProductNotFound
+	}
+	return product.public(), nil
 }
 
 func (s *FirestoreService) GetNewProducts(ctx context.Context) ([]ProductSimple, error) {
 	var products []ProductSimple
-	query := s.client.Collection(s.collection).Where("is_new", "==", true).Where("is_enabled", "==", true)
+	query := s.client.Collection(s.collection).Where("is_new", "==", true).Where("is_enabled", "==", true).Where("deleted_at", "==", nil)
 	iter := query.Documents(ctx)
 	for {
 		doc, err := iter.Next()
@@ -185,7 +443,7 @@ func (s *FirestoreService) GetNewProducts(ctx context.Context) ([]ProductSimple,
 
 func (s *FirestoreService) GetHotProducts(ctx context.Context) ([]ProductSimple, error) {
 	var products []ProductSimple
-	query := s.client.Collection(s.collection).Where("is_hot", "==", true).Where("is_enabled", "==", true)
+	query := s.client.Collection(s.collection).Where("is_hot", "==", true).Where("is_enabled", "==", true).Where("deleted_at", "==", nil)
 	iter := query.Documents(ctx)
 	for {
 		doc, err := iter.Next()
@@ -204,7 +462,7 @@ func (s *FirestoreService) GetHotProducts(ctx context.Context) ([]ProductSimple,
 }
 
 func (s *FirestoreService) CountNewProducts(ctx context.Context) (int, error) {
-	query := s.client.Collection(s.collection).Where("is_new", "==", true)
+	query := s.client.Collection(s.collection).Where("is_new", "==", true).Where("deleted_at", "==", nil)
 	iter := query.Documents(ctx)
 	count := 0
 	for {
@@ -222,7 +480,7 @@ func (s *FirestoreService) CountNewProducts(ctx context.Context) (int, error) {
 }
 
 func (s *FirestoreService) CountHotProducts(ctx context.Context) (int, error) {
-	query := s.client.Collection(s.collection).Where("is_hot", "==", true)
+	query := s.client.Collection(s.collection).Where("is_hot", "==", true).Where("deleted_at", "==", nil)
 	iter := query.Documents(ctx)
 	count := 0
 	for {
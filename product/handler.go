@@ -2,20 +2,42 @@ package product
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
 	"suto-e-shop-api/pkg/pagination"
+	"suto-e-shop-api/pkg/patch"
 )
 
+// productPatchRules lists the fields a PATCH request may change.
+var productPatchRules = map[string]patch.Rule{
+	"name":         patch.RequiredString(),
+	"category_id":  patch.String(),
+	"price":        patch.Int(0, math.MaxInt32),
+	"origin_price": patch.Int(0, math.MaxInt32),
+	"unit":         patch.String(),
+	"description":  patch.String(),
+	"content":      patch.String(),
+	"is_enabled":   patch.Bool(),
+	"image_url":    patch.String(),
+	"rating":       patch.Float(0, 5),
+	"is_new":       patch.Bool(),
+	"is_hot":       patch.Bool(),
+	"stock":        patch.Int(0, math.MaxInt32),
+}
+
 // Handler holds the product service.
 type Handler struct {
-	service Service
+	service    Service
+	categories CategoryResolver
 }
 
 // NewHandler creates a new product handler.
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service Service, categories CategoryResolver) *Handler {
+	return &Handler{service: service, categories: categories}
 }
 
 // RegisterAdminRoutes registers the product routes to the router.
@@ -25,9 +47,12 @@ func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
 
 	adminRouter.HandleFunc("", h.AdminCreateProduct).Methods("POST")
 	adminRouter.HandleFunc("", h.AdminGetProducts).Methods("GET")
+	adminRouter.HandleFunc("/trash", h.AdminGetDeletedProducts).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.AdminGetProduct).Methods("GET")
 	adminRouter.HandleFunc("/{id}", h.AdminUpdateProduct).Methods("PUT")
+	adminRouter.HandleFunc("/{id}", h.AdminPatchProduct).Methods("PATCH")
 	adminRouter.HandleFunc("/{id}", h.AdminDeleteProduct).Methods("DELETE")
+	adminRouter.HandleFunc("/{id}/restore", h.AdminRestoreProduct).Methods("POST")
 }
 
 // RegisterClientRoutes registers the product routes to the router.
@@ -46,6 +71,10 @@ func (h *Handler) AdminCreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.respondIfUnknownCategory(w, r, &product) {
+		return
+	}
+
 	// Check isNew limit
 	if product.IsNew {
 		newCount, err := h.service.CountNewProducts(r.Context())
@@ -78,6 +107,7 @@ func (h *Handler) AdminCreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, createdProduct.Version)
 	RespondWithJSON(w, http.StatusCreated, Response{Data: createdProduct, Message: "success", Code: 0})
 }
 
@@ -111,6 +141,7 @@ func (h *Handler) AdminGetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag.SetHeader(w, product.Version)
 	RespondWithJSON(w, http.StatusOK, Response{Data: product, Message: "success", Code: 0})
 }
 
@@ -118,6 +149,12 @@ func (h *Handler) AdminUpdateProduct(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
 	var product Product
 	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
@@ -131,58 +168,219 @@ func (h *Handler) AdminUpdateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check isNew limit (only if changing from false to true)
-	if product.IsNew && !existingProduct.IsNew {
+	// Check isNew/isHot limits (only if changing from false to true)
+	if h.respondIfLimitReached(w, r, product.IsNew && !existingProduct.IsNew, product.IsHot && !existingProduct.IsHot) {
+		return
+	}
+
+	if h.respondIfUnknownCategory(w, r, &product) {
+		return
+	}
+
+	updatedProduct, err := h.service.AdminUpdateProduct(r.Context(), id, version, product)
+	if errors.Is(err, ErrProductNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedProduct.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedProduct, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminPatchProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	fields, err := patch.Validate(data, productPatchRules)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existingProduct, err := h.service.AdminGetProduct(r.Context(), id)
+	if err != nil {
+		RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	isNew, _ := fields["is_new"].(bool)
+	isHot, _ := fields["is_hot"].(bool)
+	if h.respondIfLimitReached(w, r, isNew && !existingProduct.IsNew, isHot && !existingProduct.IsHot) {
+		return
+	}
+
+	if categoryID, ok := fields["category_id"].(string); ok {
+		product := Product{CategoryID: categoryID}
+		if h.respondIfUnknownCategory(w, r, &product) {
+			return
+		}
+		fields["category"] = product.Category
+	}
+
+	updatedProduct, err := h.service.AdminPatchProduct(r.Context(), id, version, fields)
+	if errors.Is(err, ErrProductNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedProduct.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedProduct, Message: "success", Code: 0})
+}
+
+// respondIfUnknownCategory fills in the category name from product.CategoryID, which must point at an existing category.
+// It writes the error response and returns true when the product must be rejected.
+func (h *Handler) respondIfUnknownCategory(w http.ResponseWriter, r *http.Request, product *Product) bool {
+	if product.CategoryID == "" {
+		product.Category = ""
+		return false
+	}
+	name, found, err := h.categories.CategoryName(r.Context(), product.CategoryID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return true
+	}
+	if !found {
+		RespondWithError(w, http.StatusBadRequest, "Unknown category_id")
+		return true
+	}
+	product.Category = name
+	return false
+}
+
+// respondIfLimitReached checks the isNew/isHot limits for flags being turned on by an update.
+// It writes the error response and returns true when the update must be rejected.
+func (h *Handler) respondIfLimitReached(w http.ResponseWriter, r *http.Request, turningNew, turningHot bool) bool {
+	if turningNew {
 		newCount, err := h.service.CountNewProducts(r.Context())
 		if err != nil {
 			RespondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+			return true
 		}
 		if newCount >= 20 {
 			RespondWithError(w, http.StatusBadRequest, "新品數量已達上限 20 個，無法設定為新品")
-			return
+			return true
 		}
 	}
 
-	// Check isHot limit (only if changing from false to true)
-	if product.IsHot && !existingProduct.IsHot {
+	if turningHot {
 		hotCount, err := h.service.CountHotProducts(r.Context())
 		if err != nil {
 			RespondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+			return true
 		}
 		if hotCount >= 20 {
 			RespondWithError(w, http.StatusBadRequest, "熱門商品數量已達上限 20 個，無法設定為熱門商品")
-			return
+			return true
 		}
 	}
 
-	updatedProduct, err := h.service.AdminUpdateProduct(r.Context(), id, product)
-	if err != nil {
+	return false
+}
+
+func (h *Handler) AdminDeleteProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := h.service.AdminDeleteProduct(r.Context(), id)
+	if errors.Is(err, ErrProductNotFound) {
 		RespondWithError(w, http.StatusNotFound, "Product not found")
 		return
 	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	RespondWithJSON(w, http.StatusOK, Response{Data: updatedProduct, Message: "success", Code: 0})
+	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
 }
 
-func (h *Handler) AdminDeleteProduct(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) AdminGetDeletedProducts(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := pagination.GetPaginationParams(r)
+
+	products, totalCount, err := h.service.AdminGetDeletedProducts(r.Context(), page, pageSize)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       products,
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
+}
+
+func (h *Handler) AdminRestoreProduct(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := h.service.AdminDeleteProduct(r.Context(), id); err != nil {
-		RespondWithError(w, http.StatusNotFound, "Product not found")
+	product, err := h.service.AdminRestoreProduct(r.Context(), id)
+	if errors.Is(err, ErrProductNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Product not found in trash")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
+	etag.SetHeader(w, product.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: product, Message: "success", Code: 0})
 }
 
 func (h *Handler) GetProducts(w http.ResponseWriter, r *http.Request) {
 	page, pageSize := pagination.GetPaginationParams(r)
 	search := r.URL.Query().Get("search")
 
-	products, totalCount, err := h.service.GetProducts(r.Context(), page, pageSize, search)
+	// Filtering by a category also includes the products of its subcategories
+	var categoryIDs []string
+	if categoryID := r.URL.Query().Get("category_id"); categoryID != "" {
+		ids, err := h.categories.DescendantIDs(r.Context(), categoryID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		categoryIDs = ids
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+
+	products, totalCount, err := h.service.GetProducts(r.Context(), page, pageSize, search, categoryIDs, sortBy, false)
+	if errors.Is(err, ErrInvalidSort) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -207,13 +405,22 @@ func (h *Handler) GetProductsIds(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	products, err := h.service.GetProductsIds(r.Context(), req.IDs)
+	if len(req.IDs) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "ids are required")
+		return
+	}
+
+	result, err := h.service.GetProductsIds(r.Context(), req.IDs)
+	if errors.Is(err, ErrTooManyIds) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	RespondWithJSON(w, http.StatusOK, Response{Data: products, Message: "success", Code: 0})
+	RespondWithJSON(w, http.StatusOK, Response{Data: result, Message: "success", Code: 0})
 }
 
 func (h *Handler) GetProduct(w http.ResponseWriter, r *http.Request) {
@@ -2,38 +2,98 @@ package product
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"time"
+
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
 )
 
 // 後台列表用
 type Product struct {
-	ID          string  `json:"id" firestore:"id"`
-	Name        string  `json:"name" firestore:"name"`
-	Category    string  `json:"category" firestore:"category"`
-	CategoryID  string  `json:"category_id" firestore:"category_id"`
-	Price       int32   `json:"price" firestore:"price"`
-	OriginPrice int32   `json:"origin_price" firestore:"origin_price"`
-	Unit        string  `json:"unit" firestore:"unit"`
-	Description string  `json:"description" firestore:"description"`
-	Content     string  `json:"content" firestore:"content"`
-	IsEnabled   bool    `json:"is_enabled" firestore:"is_enabled"`
-	ImageURL    string  `json:"image_url" firestore:"image_url"`
-	Rating      float32 `json:"rating" firestore:"rating"`
-	IsNew       bool    `json:"is_new" firestore:"is_new"`
-	IsHot       bool    `json:"is_hot" firestore:"is_hot"`
-	Stock       int32   `json:"stock" firestore:"stock"`
+	ID          string     `json:"id" firestore:"id"`
+	Name        string     `json:"name" firestore:"name"`
+	Category    string     `json:"category" firestore:"category"`
+	CategoryID  string     `json:"category_id" firestore:"category_id"`
+	Price       int32      `json:"price" firestore:"price"`
+	OriginPrice int32      `json:"origin_price" firestore:"origin_price"`
+	Unit        string     `json:"unit" firestore:"unit"`
+	Description string     `json:"description" firestore:"description"`
+	Content     string     `json:"content" firestore:"content"`
+	IsEnabled   bool       `json:"is_enabled" firestore:"is_enabled"`
+	ImageURL    string     `json:"image_url" firestore:"image_url"`
+	Rating      float32    `json:"rating" firestore:"rating"`
+	IsNew       bool       `json:"is_new" firestore:"is_new"`
+	IsHot       bool       `json:"is_hot" firestore:"is_hot"`
+	Stock       int32      `json:"stock" firestore:"stock"`
+	CreatedAt   time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" firestore:"updated_at"`
+	CreatedBy   string     `json:"created_by,omitempty" firestore:"created_by"`
+	UpdatedBy   string     `json:"updated_by,omitempty" firestore:"updated_by"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" firestore:"deleted_at"`
+	DeletedBy   string     `json:"deleted_by,omitempty" firestore:"deleted_by,omitempty"`
+	Version     string     `json:"version,omitempty" firestore:"-"`
+}
+
+// public hides the admin identities before a product is sent to the storefront.
+func (p Product) public() Product {
+	p.CreatedBy, p.UpdatedBy, p.DeletedBy = "", "", ""
+	return p
 }
 
 // 給前台列表顯示用
 type ProductSimple struct {
-	ID          string  `json:"id" firestore:"id"`
-	Category    string  `json:"category" firestore:"category"`
-	Name        string  `json:"name" firestore:"name"`
-	Price       int32   `json:"price" firestore:"price"`
-	OriginPrice int32   `json:"origin_price" firestore:"origin_price"`
-	ImageURL    string  `json:"image_url" firestore:"image_url"`
-	Rating      float32 `json:"rating" firestore:"rating"`
+	ID          string     `json:"id" firestore:"id"`
+	Category    string     `json:"category" firestore:"category"`
+	CategoryID  string     `json:"category_id" firestore:"category_id"`
+	Name        string     `json:"name" firestore:"name"`
+	Price       int32      `json:"price" firestore:"price"`
+	OriginPrice int32      `json:"origin_price" firestore:"origin_price"`
+	ImageURL    string     `json:"image_url" firestore:"image_url"`
+	Rating      float32    `json:"rating" firestore:"rating"`
+	IsEnabled   bool       `json:"-" firestore:"is_enabled"`
+	CreatedAt   time.Time  `json:"-" firestore:"created_at"`
+	DeletedAt   *time.Time `json:"-" firestore:"deleted_at"`
+}
+
+// Sort options for the storefront product listing; an empty sort keeps the default ID order.
+const (
+	SortNewest    = "newest"
+	SortPriceAsc  = "price_asc"
+	SortPriceDesc = "price_desc"
+	SortRating    = "rating"
+	SortName      = "name"
+)
+
+// ErrInvalidSort is returned when GetProducts is given a sort option it does not know.
+var ErrInvalidSort = errors.New("invalid sort, use one of newest, price_asc, price_desc, rating, name")
+
+// ErrProductNotFound is returned when the requested product does not exist.
+var ErrProductNotFound = errors.New("product not found")
+
+// MaxProductsIds caps how many IDs a single GetProductsIds call may look up.
+const MaxProductsIds = 100
+
+// ErrTooManyIds is returned when GetProductsIds is asked for more than MaxProductsIds IDs.
+var ErrTooManyIds = fmt.Errorf("too many product ids, at most %d allowed", MaxProductsIds)
+
+// 購物車用，依請求順序回傳商品，並分別列出不存在與已下架的 ID
+type ProductsIdsResult struct {
+	Products    []Product `json:"products"`
+	MissingIDs  []string  `json:"missing_ids"`
+	DisabledIDs []string  `json:"disabled_ids"`
+}
+
+// CategoryResolver looks up the categories products are filed under.
+type CategoryResolver interface {
+	// DescendantIDs expands a category into itself and its subcategories.
+	DescendantIDs(ctx context.Context, id string) ([]string, error)
+	// CategoryName returns the name of a category that exists and is not in the trash.
+	CategoryName(ctx context.Context, id string) (name string, found bool, err error)
 }
 
 // Service provides product CRUD operations.
@@ -41,10 +101,14 @@ type Service interface {
 	AdminCreateProduct(ctx context.Context, product Product) (Product, error)
 	AdminGetProducts(ctx context.Context, page, pageSize int, search string) ([]Product, int, error)
 	AdminGetProduct(ctx context.Context, id string) (Product, error)
-	AdminUpdateProduct(ctx context.Context, id string, product Product) (Product, error)
+	AdminUpdateProduct(ctx context.Context, id, version string, product Product) (Product, error)
+	AdminPatchProduct(ctx context.Context, id, version string, fields map[string]interface{}) (Product, error)
 	AdminDeleteProduct(ctx context.Context, id string) error
-	GetProducts(ctx context.Context, page, pageSize int, search string) ([]ProductSimple, int, error)
-	GetProductsIds(ctx context.Context, ids []string) ([]Product, error)
+	AdminGetDeletedProducts(ctx context.Context, page, pageSize int) ([]Product, int, error)
+	AdminRestoreProduct(ctx context.Context, id string) (Product, error)
+	PurgeDeletedProducts(ctx context.Context, before time.Time) (int, error)
+	GetProducts(ctx context.Context, page, pageSize int, search string, categoryIDs []string, sortBy string, enabledOnly bool) ([]ProductSimple, int, error)
+	GetProductsIds(ctx context.Context, ids []string) (ProductsIdsResult, error)
 	GetProduct(ctx context.Context, id string) (Product, error)
 	GetNewProducts(ctx context.Context) ([]ProductSimple, error)
 	GetHotProducts(ctx context.Context) ([]ProductSimple, error)
@@ -66,23 +130,29 @@ func NewInMemoryService() *InMemoryService {
 	}
 }
 
-func (s *InMemoryService) GetProducts(ctx context.Context, page, pageSize int, search string) ([]ProductSimple, int, error) {
+func (s *InMemoryService) GetProducts(ctx context.Context, page, pageSize int, search string, categoryIDs []string, sortBy string, enabledOnly bool) ([]ProductSimple, int, error) {
 	var productList []ProductSimple
 	for _, p := range s.products {
+		if p.DeletedAt != nil || (enabledOnly && !p.IsEnabled) || !inCategories(p.CategoryID, categoryIDs) {
+			continue
+		}
 		productList = append(productList, ProductSimple{
-			ID:    p.ID,
-			Name:  p.Name,
-			Price: p.Price,
+			ID:          p.ID,
+			Category:    p.Category,
+			CategoryID:  p.CategoryID,
+			Name:        p.Name,
+			Price:       p.Price,
 			OriginPrice: p.OriginPrice,
-			ImageURL: p.ImageURL,
-			Rating: p.Rating,
+			ImageURL:    p.ImageURL,
+			Rating:      p.Rating,
+			IsEnabled:   p.IsEnabled,
+			CreatedAt:   p.CreatedAt,
 		})
 	}
 
-	// Sort by ID for consistent pagination
-	sort.Slice(productList, func(i, j int) bool {
-		return productList[i].ID < productList[j].ID
-	})
+	if err := sortProducts(productList, sortBy); err != nil {
+		return nil, 0, err
+	}
 
 	totalCount := len(productList)
 
@@ -100,30 +170,117 @@ func (s *InMemoryService) GetProducts(ctx context.Context, page, pageSize int, s
 	return productList[start:end], totalCount, nil
 }
 
-func (s *InMemoryService) GetProductsIds(ctx context.Context, ids []string) ([]Product, error) {
-	var productList []Product
+func (s *InMemoryService) GetProductsIds(ctx context.Context, ids []string) (ProductsIdsResult, error) {
+	ids = uniqueIds(ids)
+	if len(ids) > MaxProductsIds {
+		return ProductsIdsResult{}, ErrTooManyIds
+	}
+
+	result := newProductsIdsResult(len(ids))
 	for _, id := range ids {
 		product, ok := s.products[id]
-		if !ok {
-			return nil, fmt.Errorf("product not found")
+		if !ok || product.DeletedAt != nil {
+			result.MissingIDs = append(result.MissingIDs, id)
+			continue
 		}
-		productList = append(productList, product)
+		if !product.IsEnabled {
+			result.DisabledIDs = append(result.DisabledIDs, id)
+			continue
+		}
+		result.Products = append(result.Products, product.public())
 	}
-	return productList, nil
+	return result, nil
+}
+
+// sortProducts orders a listing by sortBy. Ties, and the default order, fall back to the ID for consistent pagination.
+func sortProducts(products []ProductSimple, sortBy string) error {
+	var less func(a, b ProductSimple) bool
+	switch sortBy {
+	case "":
+		less = func(a, b ProductSimple) bool { return false }
+	case SortNewest:
+		less = func(a, b ProductSimple) bool { return a.CreatedAt.After(b.CreatedAt) }
+	case SortPriceAsc:
+		less = func(a, b ProductSimple) bool { return a.Price < b.Price }
+	case SortPriceDesc:
+		less = func(a, b ProductSimple) bool { return a.Price > b.Price }
+	case SortRating:
+		less = func(a, b ProductSimple) bool { return a.Rating > b.Rating }
+	case SortName:
+		less = func(a, b ProductSimple) bool { return a.Name < b.Name }
+	default:
+		return ErrInvalidSort
+	}
+
+	sort.Slice(products, func(i, j int) bool {
+		if less(products[i], products[j]) {
+			return true
+		}
+		if less(products[j], products[i]) {
+			return false
+		}
+		return products[i].ID < products[j].ID
+	})
+	return nil
+}
+
+// inCategories reports whether categoryID is one of categoryIDs; an empty filter matches everything.
+func inCategories(categoryID string, categoryIDs []string) bool {
+	if len(categoryIDs) == 0 {
+		return true
+	}
+	for _, id := range categoryIDs {
+		if id == categoryID {
+			return true
+		}
+	}
+	return false
+}
+
+// nextVersion mimics a Firestore update time for the in-memory store.
+func nextVersion() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// newProductsIdsResult returns a result whose slices encode as [] rather than null.
+func newProductsIdsResult(capacity int) ProductsIdsResult {
+	return ProductsIdsResult{
+		Products:    make([]Product, 0, capacity),
+		MissingIDs:  []string{},
+		DisabledIDs: []string{},
+	}
+}
+
+// uniqueIds drops duplicate IDs while keeping the order of first appearance.
+func uniqueIds(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique
 }
 
 
 func (s *InMemoryService) GetProduct(ctx context.Context, id string) (Product, error) {
 	product, ok := s.products[id]
-	if !ok {
-		return Product{}, fmt.Errorf("product not found")
+	if !ok || product.DeletedAt != nil {
+		return Product{}, ErrProductNotFound
 	}
-	return product, nil
+	return product.public(), nil
 }
 
 func (s *InMemoryService) AdminCreateProduct(ctx context.Context, product Product) (Product, error) {
 	product.ID = fmt.Sprintf("%d", s.nextProductID)
 	s.nextProductID++
+	product.Version = nextVersion()
+	now, actor := time.Now(), auth.Actor(ctx)
+	product.CreatedAt, product.UpdatedAt = now, now
+	product.CreatedBy, product.UpdatedBy = actor, actor
 	s.products[product.ID] = product
 	return product, nil
 }
@@ -131,6 +288,9 @@ func (s *InMemoryService) AdminCreateProduct(ctx context.Context, product Produc
 func (s *InMemoryService) AdminGetProducts(ctx context.Context, page, pageSize int, search string) ([]Product, int, error) {
 	var productList []Product
 	for _, p := range s.products {
+		if p.DeletedAt != nil {
+			continue
+		}
 		productList = append(productList, p)
 	}
 
@@ -158,32 +318,134 @@ func (s *InMemoryService) AdminGetProducts(ctx context.Context, page, pageSize i
 func (s *InMemoryService) AdminGetProduct(ctx context.Context, id string) (Product, error) {
 	product, ok := s.products[id]
 	if !ok {
-		return Product{}, fmt.Errorf("product not found")
+		return Product{}, ErrProductNotFound
 	}
 	return product, nil
 }
 
-func (s *InMemoryService) AdminUpdateProduct(ctx context.Context, id string, product Product) (Product, error) {
-	if _, ok := s.products[id]; !ok {
-		return Product{}, fmt.Errorf("product not found")
+func (s *InMemoryService) AdminUpdateProduct(ctx context.Context, id, version string, product Product) (Product, error) {
+	existing, ok := s.products[id]
+	if !ok || existing.DeletedAt != nil {
+		return Product{}, ErrProductNotFound
+	}
+	if existing.Version != version {
+		return Product{}, etag.ErrPreconditionFailed
 	}
 	product.ID = id
+	product.Version = nextVersion()
+	product.CreatedAt, product.CreatedBy = existing.CreatedAt, existing.CreatedBy
+	product.DeletedAt, product.DeletedBy = nil, ""
+	product.UpdatedAt, product.UpdatedBy = time.Now(), auth.Actor(ctx)
 	s.products[id] = product
 	return product, nil
 }
 
+func (s *InMemoryService) AdminPatchProduct(ctx context.Context, id, version string, fields map[string]interface{}) (Product, error) {
+	product, ok := s.products[id]
+	if !ok || product.DeletedAt != nil {
+		return Product{}, ErrProductNotFound
+	}
+	if product.Version != version {
+		return Product{}, etag.ErrPreconditionFailed
+	}
+
+	// Round-trip through JSON so the field names match the Firestore paths.
+	raw, err := json.Marshal(product)
+	if err != nil {
+		return Product{}, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return Product{}, err
+	}
+	for key, value := range fields {
+		doc[key] = value
+	}
+	doc["updated_at"] = time.Now()
+	doc["updated_by"] = auth.Actor(ctx)
+	raw, err = json.Marshal(doc)
+	if err != nil {
+		return Product{}, err
+	}
+	var patched Product
+	if err := json.Unmarshal(raw, &patched); err != nil {
+		return Product{}, err
+	}
+
+	patched.ID = id
+	patched.Version = nextVersion()
+	s.products[id] = patched
+	return patched, nil
+}
+
 func (s *InMemoryService) AdminDeleteProduct(ctx context.Context, id string) error {
-	if _, ok := s.products[id]; !ok {
-		return fmt.Errorf("product not found")
+	product, ok := s.products[id]
+	if !ok || product.DeletedAt != nil {
+		return ErrProductNotFound
 	}
-	delete(s.products, id)
+	now := time.Now()
+	product.DeletedAt, product.DeletedBy = &now, auth.Actor(ctx)
+	product.Version = nextVersion()
+	s.products[id] = product
 	return nil
 }
 
+func (s *InMemoryService) AdminGetDeletedProducts(ctx context.Context, page, pageSize int) ([]Product, int, error) {
+	var productList []Product
+	for _, p := range s.products {
+		if p.DeletedAt != nil {
+			productList = append(productList, p)
+		}
+	}
+
+	// Most recently deleted first
+	sort.Slice(productList, func(i, j int) bool {
+		return productList[i].DeletedAt.After(*productList[j].DeletedAt)
+	})
+
+	totalCount := len(productList)
+
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Product{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	return productList[start:end], totalCount, nil
+}
+
+func (s *InMemoryService) AdminRestoreProduct(ctx context.Context, id string) (Product, error) {
+	product, ok := s.products[id]
+	if !ok || product.DeletedAt == nil {
+		return Product{}, ErrProductNotFound
+	}
+	product.DeletedAt, product.DeletedBy = nil, ""
+	product.UpdatedAt, product.UpdatedBy = time.Now(), auth.Actor(ctx)
+	product.Version = nextVersion()
+	s.products[id] = product
+	return product, nil
+}
+
+func (s *InMemoryService) PurgeDeletedProducts(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for id, p := range s.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			delete(s.products, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
 func (s *InMemoryService) GetNewProducts(ctx context.Context) ([]ProductSimple, error) {
 	var products []ProductSimple
 	for _, p := range s.products {
-		if p.IsNew && p.IsEnabled {
+		if p.IsNew && p.IsEnabled && p.DeletedAt == nil {
 			products = append(products, ProductSimple{
 				ID:          p.ID,
 				Category:    p.Category,
@@ -201,7 +463,7 @@ func (s *InMemoryService) GetNewProducts(ctx context.Context) ([]ProductSimple,
 func (s *InMemoryService) GetHotProducts(ctx context.Context) ([]ProductSimple, error) {
 	var products []ProductSimple
 	for _, p := range s.products {
-		if p.IsHot && p.IsEnabled {
+		if p.IsHot && p.IsEnabled && p.DeletedAt == nil {
 			products = append(products, ProductSimple{
 				ID:          p.ID,
 				Category:    p.Category,
@@ -219,7 +481,7 @@ func (s *InMemoryService) GetHotProducts(ctx context.Context) ([]ProductSimple,
 func (s *InMemoryService) CountNewProducts(ctx context.Context) (int, error) {
 	count := 0
 	for _, p := range s.products {
-		if p.IsNew {
+		if p.IsNew && p.DeletedAt == nil {
 			count++
 		}
 	}
@@ -229,7 +491,7 @@ func (s *InMemoryService) CountNewProducts(ctx context.Context) (int, error) {
 func (s *InMemoryService) CountHotProducts(ctx context.Context) (int, error) {
 	count := 0
 	for _, p := range s.products {
-		if p.IsHot {
+		if p.IsHot && p.DeletedAt == nil {
 			count++
 		}
 	}
@@ -0,0 +1,108 @@
+package product
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUniqueIds(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		want []string
+	}{
+		{"nil", nil, []string{}},
+		{"no duplicates", []string{"b", "a"}, []string{"b", "a"}},
+		{"duplicates keep first appearance", []string{"b", "a", "b", "c", "a"}, []string{"b", "a", "c"}},
+		{"empty ID kept once", []string{"", "a", ""}, []string{"", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uniqueIds(tt.ids); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("uniqueIds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// manyIds returns n distinct IDs.
+func manyIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("p%d", i)
+	}
+	return ids
+}
+
+func TestGetProductsIdsLimit(t *testing.T) {
+	s := NewInMemoryService()
+
+	tests := []struct {
+		name    string
+		ids     []string
+		wantErr error
+	}{
+		{"at the limit", manyIds(MaxProductsIds), nil},
+		{"duplicates do not count", append(manyIds(MaxProductsIds), manyIds(10)...), nil},
+		{"over the limit", manyIds(MaxProductsIds + 1), ErrTooManyIds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.GetProductsIds(context.Background(), tt.ids); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetProductsIds() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetProductsIdsResult(t *testing.T) {
+	deletedAt := time.Now()
+	s := NewInMemoryService()
+	s.products = map[string]Product{
+		"enabled":  {ID: "enabled", IsEnabled: true, CreatedBy: "admin"},
+		"disabled": {ID: "disabled"},
+		"deleted":  {ID: "deleted", IsEnabled: true, DeletedAt: &deletedAt},
+	}
+
+	result, err := s.GetProductsIds(context.Background(), []string{"missing", "enabled", "deleted", "disabled", "enabled"})
+	if err != nil {
+		t.Fatalf("GetProductsIds() error = %v", err)
+	}
+	if len(result.Products) != 1 || result.Products[0].ID != "enabled" || result.Products[0].CreatedBy != "" {
+		t.Errorf("Products = %+v, want only the enabled product without admin fields", result.Products)
+	}
+	if want := []string{"missing", "deleted"}; !reflect.DeepEqual(result.MissingIDs, want) {
+		t.Errorf("MissingIDs = %v, want %v", result.MissingIDs, want)
+	}
+	if want := []string{"disabled"}; !reflect.DeepEqual(result.DisabledIDs, want) {
+		t.Errorf("DisabledIDs = %v, want %v", result.DisabledIDs, want)
+	}
+}
+
+func TestPurgeDeletedProducts(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	before, at := cutoff.Add(-time.Second), cutoff
+	s := NewInMemoryService()
+	s.products = map[string]Product{
+		"active":         {ID: "active"},
+		"trashed before": {ID: "trashed before", DeletedAt: &before},
+		"trashed at":     {ID: "trashed at", DeletedAt: &at},
+	}
+
+	purged, err := s.PurgeDeletedProducts(context.Background(), cutoff)
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeDeletedProducts() = %d, %v, want 1", purged, err)
+	}
+	if _, ok := s.products["trashed before"]; ok {
+		t.Error("product trashed before the cutoff was kept")
+	}
+	for _, id := range []string{"active", "trashed at"} {
+		if _, ok := s.products[id]; !ok {
+			t.Errorf("product %q was purged", id)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package shipping
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"suto-e-shop-api/auth"
+	"suto-e-shop-api/pkg/etag"
+)
+
+// FirestoreService keeps the shipping rules in a single settings document.
+type FirestoreService struct {
+	client     *firestore.Client
+	collection string
+	document   string
+}
+
+// NewFirestoreService creates a new Firestore-backed shipping service.
+func NewFirestoreService(client *firestore.Client) *FirestoreService {
+	return &FirestoreService{
+		client:     client,
+		collection: "settings",
+		document:   "shipping",
+	}
+}
+
+func (s *FirestoreService) ref() *firestore.DocumentRef {
+	return s.client.Collection(s.collection).Doc(s.document)
+}
+
+// AdminGetRules returns the saved rules. The defaults are saved on first use, so there is always
+// a version to send back in If-Match.
+func (s *FirestoreService) AdminGetRules(ctx context.Context) (Rules, error) {
+	doc, err := s.ref().Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		_, err = s.ref().Create(ctx, DefaultRules())
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			log.Printf("Failed to create shipping rules: %v", err)
+			return Rules{}, err
+		}
+		doc, err = s.ref().Get(ctx)
+	}
+	if err != nil {
+		log.Printf("Failed to get shipping rules: %v", err)
+		return Rules{}, err
+	}
+
+	rules, err := savedRules(doc)
+	if err != nil {
+		return Rules{}, err
+	}
+	rules.Version = etag.Version(doc.UpdateTime)
+	return rules, nil
+}
+
+func (s *FirestoreService) AdminUpdateRules(ctx context.Context, version string, rules Rules) (Rules, error) {
+	if err := rules.validate(); err != nil {
+		return Rules{}, err
+	}
+	updateTime, err := etag.Time(version)
+	if err != nil {
+		return Rules{}, err
+	}
+
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(s.ref())
+		if err != nil {
+			return err
+		}
+		if !doc.UpdateTime.Equal(updateTime) {
+			return etag.ErrPreconditionFailed
+		}
+		rules.UpdatedAt, rules.UpdatedBy = time.Now(), auth.Actor(ctx)
+		return tx.Set(s.ref(), rules)
+	})
+	// Rules that were never read have no version yet, so any If-Match is stale.
+	if status.Code(err) == codes.NotFound || errors.Is(err, etag.ErrPreconditionFailed) {
+		return Rules{}, etag.ErrPreconditionFailed
+	}
+	if err != nil {
+		log.Printf("Failed to update shipping rules: %v", err)
+		return Rules{}, err
+	}
+	return s.AdminGetRules(ctx)
+}
+
+// Quote prices an order under the current rules, or the defaults if none were saved.
+func (s *FirestoreService) Quote(ctx context.Context, req QuoteRequest) (Quote, error) {
+	doc, err := s.ref().Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return DefaultRules().quote(req)
+	}
+	if err != nil {
+		log.Printf("Failed to get shipping rules: %v", err)
+		return Quote{}, err
+	}
+	rules, err := savedRules(doc)
+	if err != nil {
+		return Quote{}, err
+	}
+	return rules.quote(req)
+}
+
+// savedRules reads a saved rules document. It starts from zero rules, since decoding merges into
+// maps: starting from the defaults would bring back every rate the admin removed, at fee 0.
+func savedRules(doc interface{ DataTo(p interface{}) error }) (Rules, error) {
+	var rules Rules
+	if err := doc.DataTo(&rules); err != nil {
+		return Rules{}, err
+	}
+	return rules, nil
+}
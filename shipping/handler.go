@@ -0,0 +1,114 @@
+package shipping
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/etag"
+)
+
+// Handler holds the shipping service.
+type Handler struct {
+	service Service
+}
+
+// NewHandler creates a new shipping handler.
+func NewHandler(service Service) *Handler {
+	return &Handler{service: service}
+}
+
+// RegisterAdminRoutes registers the admin shipping routes to the router.
+func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/shipping", h.AdminGetRules).Methods("GET")
+	router.HandleFunc("/shipping", h.AdminUpdateRules).Methods("PUT")
+}
+
+// RegisterClientRoutes registers the client shipping routes to the router.
+func (h *Handler) RegisterClientRoutes(router *mux.Router) {
+	router.HandleFunc("/shipping/quote", h.Quote).Methods("POST")
+}
+
+func (h *Handler) AdminGetRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.service.AdminGetRules(r.Context())
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, rules.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: rules, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminUpdateRules(w http.ResponseWriter, r *http.Request) {
+	version, err := etag.IfMatch(r)
+	if err != nil {
+		RespondWithError(w, etag.StatusCode(err), err.Error())
+		return
+	}
+
+	var rules Rules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	updatedRules, err := h.service.AdminUpdateRules(r.Context(), version, rules)
+	if errors.Is(err, ErrInvalidRules) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, etag.ErrPreconditionFailed) {
+		RespondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag.SetHeader(w, updatedRules.Version)
+	RespondWithJSON(w, http.StatusOK, Response{Data: updatedRules, Message: "success", Code: 0})
+}
+
+// Quote previews the shipping fee of a cart, taking the same method, address and products as an order.
+func (h *Handler) Quote(w http.ResponseWriter, r *http.Request) {
+	var req QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := ValidateItems(req.Items); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	quote, err := h.service.Quote(r.Context(), req)
+	if errors.Is(err, ErrMethodUnavailable) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Data: quote, Message: "success", Code: 0})
+}
+
+// ValidateItems checks the counts and prices of the items to quote.
+func ValidateItems(items []Item) error {
+	if len(items) == 0 {
+		return errors.New("products are required")
+	}
+	for _, item := range items {
+		if item.Count <= 0 {
+			return errors.New("product count must be positive")
+		}
+		if item.Price <= 0 {
+			return errors.New("product price must be positive")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package shipping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fulfillment methods that can have a rate. The order package names them for its customers.
+const (
+	MethodStorePickup      = "store_pickup"
+	MethodHomeDelivery     = "home_delivery"
+	MethodConvenienceStore = "convenience_store"
+)
+
+// Methods lists every fulfillment method a rate can be set for.
+var Methods = []string{MethodStorePickup, MethodHomeDelivery, MethodConvenienceStore}
+
+// Bases that island tiers can be measured in. Products have no recorded weight yet, so weight
+// tiers are rejected rather than priced on weights the client sends.
+const (
+	BasisQuantity = "quantity"
+	BasisWeight   = "weight"
+)
+
+var (
+	// ErrInvalidRules is returned when saving rules that cannot be applied.
+	ErrInvalidRules = errors.New("invalid shipping rules")
+	// ErrMethodUnavailable is returned when quoting a fulfillment method that has no rate.
+	ErrMethodUnavailable = errors.New("shipping is not available for this fulfillment method")
+)
+
+// Rules decide the shipping fee of an order. Each fulfillment method has a flat rate, which is waived
+// once the subtotal reaches FreeThreshold. Addresses containing one of IslandKeywords are outlying
+// islands; when IslandTiers are set they replace the flat rate there and free shipping does not apply.
+type Rules struct {
+	Rates          map[string]int `json:"rates" firestore:"rates"`
+	FreeThreshold  int            `json:"free_threshold" firestore:"free_threshold"`
+	IslandKeywords []string       `json:"island_keywords" firestore:"island_keywords"`
+	IslandBasis    string         `json:"island_basis,omitempty" firestore:"island_basis,omitempty"`
+	IslandTiers    []Tier         `json:"island_tiers" firestore:"island_tiers"`
+	UpdatedAt      time.Time      `json:"updated_at,omitempty" firestore:"updated_at"`
+	UpdatedBy      string         `json:"updated_by,omitempty" firestore:"updated_by"`
+	Version        string         `json:"version,omitempty" firestore:"-"`
+}
+
+// Tier is the fee for orders up to UpTo items.
+// The last tier has UpTo 0 and covers everything above the others.
+type Tier struct {
+	UpTo int `json:"up_to" firestore:"up_to"`
+	Fee  int `json:"fee" firestore:"fee"`
+}
+
+// DefaultRules are used until an admin saves rules. They charge nothing, like orders did before
+// shipping fees existed.
+func DefaultRules() Rules {
+	return Rules{
+		Rates: map[string]int{
+			MethodStorePickup:      0,
+			MethodHomeDelivery:     0,
+			MethodConvenienceStore: 0,
+		},
+		IslandKeywords: []string{"澎湖", "金門", "連江", "馬祖", "綠島", "蘭嶼", "琉球鄉"},
+		IslandTiers:    []Tier{},
+	}
+}
+
+// Item is one line of a cart or order.
+type Item struct {
+	Count int `json:"count"`
+	Price int `json:"price"`
+}
+
+// QuoteRequest is what the fee depends on: the method, the delivery address and the items.
+type QuoteRequest struct {
+	Method  string `json:"method"`
+	Address string `json:"address,omitempty"`
+	Items   []Item `json:"products"`
+}
+
+// Quote is the price breakdown of an order. FreeShippingRemaining is how much more the cart needs
+// for free shipping, or 0 when it already ships free or free shipping does not apply.
+type Quote struct {
+	Subtotal              int  `json:"subtotal"`
+	ShippingFee           int  `json:"shipping_fee"`
+	Total                 int  `json:"total"`
+	Island                bool `json:"island"`
+	FreeShippingRemaining int  `json:"free_shipping_remaining"`
+}
+
+// Service provides shipping rules and fee quotes.
+type Service interface {
+	// Admin operations
+	AdminGetRules(ctx context.Context) (Rules, error)
+	AdminUpdateRules(ctx context.Context, version string, rules Rules) (Rules, error)
+
+	// Client operations
+	Quote(ctx context.Context, req QuoteRequest) (Quote, error)
+}
+
+// validate checks that the rules can price every order.
+func (r Rules) validate() error {
+	if len(r.Rates) == 0 {
+		return fmt.Errorf("%w: at least one rate is required", ErrInvalidRules)
+	}
+	for method, fee := range r.Rates {
+		if !slices.Contains(Methods, method) {
+			return fmt.Errorf("%w: rates must be for one of %s", ErrInvalidRules, strings.Join(Methods, ", "))
+		}
+		if fee < 0 {
+			return fmt.Errorf("%w: rates need a fee of at least 0", ErrInvalidRules)
+		}
+	}
+	if r.FreeThreshold < 0 {
+		return fmt.Errorf("%w: free_threshold must be at least 0", ErrInvalidRules)
+	}
+	for _, keyword := range r.IslandKeywords {
+		if strings.TrimSpace(keyword) == "" {
+			return fmt.Errorf("%w: island_keywords must not be blank", ErrInvalidRules)
+		}
+	}
+	if len(r.IslandTiers) == 0 {
+		return nil
+	}
+
+	if r.IslandBasis == BasisWeight {
+		return fmt.Errorf("%w: island_basis weight is not supported until products have a weight", ErrInvalidRules)
+	}
+	if r.IslandBasis != BasisQuantity {
+		return fmt.Errorf("%w: island_basis must be quantity", ErrInvalidRules)
+	}
+	last := len(r.IslandTiers) - 1
+	for i, tier := range r.IslandTiers {
+		if tier.Fee < 0 {
+			return fmt.Errorf("%w: island tier fees must be at least 0", ErrInvalidRules)
+		}
+		if i == last {
+			if tier.UpTo != 0 {
+				return fmt.Errorf("%w: the last island tier must have up_to 0 to cover larger orders", ErrInvalidRules)
+			}
+			continue
+		}
+		if tier.UpTo <= 0 || (i > 0 && tier.UpTo <= r.IslandTiers[i-1].UpTo) {
+			return fmt.Errorf("%w: island tier up_to must be positive and increasing", ErrInvalidRules)
+		}
+	}
+	return nil
+}
+
+// quote prices the request under the rules.
+func (r Rules) quote(req QuoteRequest) (Quote, error) {
+	fee, ok := r.Rates[req.Method]
+	if !ok {
+		return Quote{}, ErrMethodUnavailable
+	}
+
+	var q Quote
+	quantity := 0
+	for _, item := range req.Items {
+		q.Subtotal += item.Price * item.Count
+		quantity += item.Count
+	}
+	q.Island = req.Address != "" && r.isIsland(req.Address)
+
+	switch {
+	case q.Island && len(r.IslandTiers) > 0:
+		fee = r.tierFee(quantity)
+	case r.FreeThreshold > 0 && fee > 0:
+		if q.Subtotal >= r.FreeThreshold {
+			fee = 0
+		} else {
+			q.FreeShippingRemaining = r.FreeThreshold - q.Subtotal
+		}
+	}
+
+	q.ShippingFee = fee
+	q.Total = q.Subtotal + fee
+	return q, nil
+}
+
+// isIsland reports whether the address is on an outlying island.
+func (r Rules) isIsland(address string) bool {
+	// Addresses are written with either form of the character for "Tai".
+	address = strings.ReplaceAll(address, "臺", "台")
+	for _, keyword := range r.IslandKeywords {
+		if strings.Contains(address, strings.ReplaceAll(keyword, "臺", "台")) {
+			return true
+		}
+	}
+	return false
+}
+
+// tierFee returns the fee of the first tier that amount fits in; validate guarantees the last tier fits all.
+func (r Rules) tierFee(amount int) int {
+	for _, tier := range r.IslandTiers {
+		if tier.UpTo == 0 || amount <= tier.UpTo {
+			return tier.Fee
+		}
+	}
+	return r.IslandTiers[len(r.IslandTiers)-1].Fee
+}
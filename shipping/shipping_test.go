@@ -0,0 +1,134 @@
+package shipping
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRulesValidate(t *testing.T) {
+	tiers := []Tier{{UpTo: 3, Fee: 100}, {UpTo: 0, Fee: 200}}
+
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr bool
+	}{
+		{"defaults", DefaultRules(), false},
+		{"no rates", Rules{}, true},
+		{"unknown method", Rules{Rates: map[string]int{"drone": 60}}, true},
+		{"negative fee", Rules{Rates: map[string]int{MethodHomeDelivery: -1}}, true},
+		{"negative threshold", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, FreeThreshold: -1}, true},
+		{"blank keyword", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandKeywords: []string{" "}}, true},
+		{"quantity tiers", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandBasis: BasisQuantity, IslandTiers: tiers}, false},
+		{"weight tiers", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandBasis: BasisWeight, IslandTiers: tiers}, true},
+		{"tiers without basis", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandTiers: tiers}, true},
+		{"last tier bounded", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandBasis: BasisQuantity, IslandTiers: []Tier{{UpTo: 3, Fee: 100}}}, true},
+		{"tiers not increasing", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandBasis: BasisQuantity, IslandTiers: []Tier{{UpTo: 3, Fee: 100}, {UpTo: 3, Fee: 150}, {Fee: 200}}}, true},
+		{"negative tier fee", Rules{Rates: map[string]int{MethodHomeDelivery: 60}, IslandBasis: BasisQuantity, IslandTiers: []Tier{{Fee: -1}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidRules) {
+				t.Errorf("validate() error = %v, want ErrInvalidRules", err)
+			}
+		})
+	}
+}
+
+func TestRulesQuote(t *testing.T) {
+	rules := Rules{
+		Rates:          map[string]int{MethodStorePickup: 0, MethodHomeDelivery: 100},
+		FreeThreshold:  1000,
+		IslandKeywords: []string{"澎湖", "臺東縣蘭嶼"},
+		IslandBasis:    BasisQuantity,
+		IslandTiers:    []Tier{{UpTo: 2, Fee: 150}, {UpTo: 0, Fee: 300}},
+	}
+
+	tests := []struct {
+		name    string
+		req     QuoteRequest
+		want    Quote
+		wantErr error
+	}{
+		{
+			name: "flat rate below threshold",
+			req:  QuoteRequest{Method: MethodHomeDelivery, Address: "台北市", Items: []Item{{Count: 2, Price: 300}}},
+			want: Quote{Subtotal: 600, ShippingFee: 100, Total: 700, FreeShippingRemaining: 400},
+		},
+		{
+			name: "free at threshold",
+			req:  QuoteRequest{Method: MethodHomeDelivery, Address: "台北市", Items: []Item{{Count: 1, Price: 1000}}},
+			want: Quote{Subtotal: 1000, Total: 1000},
+		},
+		{
+			name: "free method has nothing remaining",
+			req:  QuoteRequest{Method: MethodStorePickup, Items: []Item{{Count: 1, Price: 100}}},
+			want: Quote{Subtotal: 100, Total: 100},
+		},
+		{
+			name: "island small tier",
+			req:  QuoteRequest{Method: MethodHomeDelivery, Address: "澎湖縣馬公市", Items: []Item{{Count: 2, Price: 600}}},
+			want: Quote{Subtotal: 1200, ShippingFee: 150, Total: 1350, Island: true},
+		},
+		{
+			name: "island last tier",
+			req:  QuoteRequest{Method: MethodHomeDelivery, Address: "澎湖縣馬公市", Items: []Item{{Count: 1, Price: 100}, {Count: 2, Price: 100}}},
+			want: Quote{Subtotal: 300, ShippingFee: 300, Total: 600, Island: true},
+		},
+		{
+			name: "island keyword with the other Tai",
+			req:  QuoteRequest{Method: MethodHomeDelivery, Address: "台東縣蘭嶼鄉", Items: []Item{{Count: 1, Price: 100}}},
+			want: Quote{Subtotal: 100, ShippingFee: 150, Total: 250, Island: true},
+		},
+		{
+			name:    "method without rate",
+			req:     QuoteRequest{Method: MethodConvenienceStore, Items: []Item{{Count: 1, Price: 100}}},
+			wantErr: ErrMethodUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rules.quote(tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("quote() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("quote() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// savedDoc stands in for a Firestore snapshot. Like DataTo, decoding JSON merges into maps that are
+// already filled.
+type savedDoc string
+
+func (d savedDoc) DataTo(p interface{}) error {
+	return json.Unmarshal([]byte(d), p)
+}
+
+func TestSavedRulesDropsRemovedMethods(t *testing.T) {
+	// The admin removed home delivery, so the saved rates have no key for it.
+	doc := savedDoc(`{"rates": {"store_pickup": 0, "convenience_store": 60}}`)
+
+	rules, err := savedRules(doc)
+	if err != nil {
+		t.Fatalf("savedRules() error = %v", err)
+	}
+	if _, ok := rules.Rates[MethodHomeDelivery]; ok {
+		t.Errorf("rates = %v, want no home_delivery", rules.Rates)
+	}
+	_, err = rules.quote(QuoteRequest{Method: MethodHomeDelivery, Address: "台北市", Items: []Item{{Count: 1, Price: 100}}})
+	if !errors.Is(err, ErrMethodUnavailable) {
+		t.Errorf("quote() error = %v, want ErrMethodUnavailable", err)
+	}
+	quote, err := rules.quote(QuoteRequest{Method: MethodConvenienceStore, Items: []Item{{Count: 1, Price: 100}}})
+	if err != nil || quote.ShippingFee != 60 {
+		t.Errorf("quote() = %+v, %v, want the saved fee of 60", quote, err)
+	}
+}
@@ -0,0 +1,23 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrObjectNotFound is returned by a Backend when the object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Backend stores the uploaded files. Object paths use forward slashes, e.g. product/<id>/large.jpg.
+type Backend interface {
+	// Put stores data at objectPath, replacing any existing object.
+	Put(ctx context.Context, objectPath, contentType string, data []byte) error
+	// Read returns at most maxSize bytes of the object and the content type it was stored with.
+	Read(ctx context.Context, objectPath string, maxSize int64) ([]byte, string, error)
+	// Delete removes the object; an object that is already gone is not an error.
+	Delete(ctx context.Context, objectPath string) error
+	// SignPut returns a URL the client can PUT a file of at most size bytes to until expires,
+	// along with the headers the client has to send with it.
+	SignPut(ctx context.Context, objectPath, contentType string, size int64, expires time.Time) (string, map[string]string, error)
+}
@@ -0,0 +1,114 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSBackend stores uploads in a Cloud Storage bucket. Public read access is granted on the
+// bucket with IAM rather than per object, so it also works on uniform bucket-level access buckets.
+type GCSBackend struct {
+	client     *storage.Client
+	bucketName string
+}
+
+// NewGCSBackend creates a Cloud Storage backend for the given bucket.
+func NewGCSBackend(client *storage.Client, bucketName string) *GCSBackend {
+	return &GCSBackend{
+		client:     client,
+		bucketName: bucketName,
+	}
+}
+
+func (b *GCSBackend) Put(ctx context.Context, objectPath, contentType string, data []byte) error {
+	// Create a writer for the object
+	writer := b.client.Bucket(b.bucketName).Object(objectPath).NewWriter(ctx)
+	writer.ContentType = contentType
+	// Object names are unique per upload, so browsers and CDNs may cache them for good.
+	writer.CacheControl = "public, max-age=31536000, immutable"
+
+	// Write the file data
+	if _, err := writer.Write(data); err != nil {
+		log.Printf("Failed to write file data: %v", err)
+		return fmt.Errorf("failed to write file data: %w", err)
+	}
+
+	// Close the writer to finalize the upload
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to close writer: %v", err)
+		return fmt.Errorf("failed to close writer: %w", err)
+	}
+	return nil
+}
+
+func (b *GCSBackend) Read(ctx context.Context, objectPath string, maxSize int64) ([]byte, string, error) {
+	reader, err := b.client.Bucket(b.bucketName).Object(objectPath).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, "", ErrObjectNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to open object %s: %v", objectPath, err)
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxSize))
+	if err != nil {
+		log.Printf("Failed to read object %s: %v", objectPath, err)
+		return nil, "", err
+	}
+	return data, reader.Attrs.ContentType, nil
+}
+
+func (b *GCSBackend) Delete(ctx context.Context, objectPath string) error {
+	err := b.client.Bucket(b.bucketName).Object(objectPath).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		log.Printf("Failed to delete object %s: %v", objectPath, err)
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+// SignPut issues a V4 signed URL. The content length range header makes Cloud Storage itself
+// reject bodies larger than size.
+func (b *GCSBackend) SignPut(ctx context.Context, objectPath, contentType string, size int64, expires time.Time) (string, map[string]string, error) {
+	lengthRange := fmt.Sprintf("0,%d", size)
+	opts := &storage.SignedURLOptions{
+		Scheme:      storage.SigningSchemeV4,
+		Method:      "PUT",
+		ContentType: contentType,
+		Headers:     []string{"x-goog-content-length-range:" + lengthRange},
+		Expires:     expires,
+	}
+
+	url, err := b.client.Bucket(b.bucketName).SignedURL(objectPath, opts)
+	if err != nil {
+		log.Printf("Failed to sign upload URL: %v", err)
+		return "", nil, fmt.Errorf("failed to generate signed URL: %w", err)
+	}
+	return url, map[string]string{
+		"Content-Type":                contentType,
+		"x-goog-content-length-range": lengthRange,
+	}, nil
+}
+
+// GetSignedURL generates a signed URL for the object (optional, for private access)
+func (b *GCSBackend) GetSignedURL(ctx context.Context, objectPath string, expiration time.Duration) (string, error) {
+	opts := &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expiration),
+	}
+
+	url, err := b.client.Bucket(b.bucketName).SignedURL(objectPath, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate signed URL: %w", err)
+	}
+
+	return url, nil
+}
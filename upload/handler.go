@@ -1,41 +1,62 @@
 package upload
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"suto-e-shop-api/pkg/pagination"
 )
 
 // Handler holds the upload service.
 type Handler struct {
-	service Service
+	service  Service
+	types    map[string]TypeRule
+	allowSVG bool
 }
 
-// NewHandler creates a new upload handler.
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+// NewHandler creates a new upload handler. SVG uploads are rejected unless allowSVG is set,
+// and are sanitized when they are allowed.
+func NewHandler(service Service, allowSVG bool) *Handler {
+	return &Handler{service: service, types: Types, allowSVG: allowSVG}
 }
 
 // RegisterAdminRoutes registers the admin upload routes to the router.
 func (h *Handler) RegisterAdminRoutes(router *mux.Router) {
 	router.HandleFunc("/upload", h.UploadImage).Methods("POST")
+	router.HandleFunc("/upload/sign", h.SignUpload).Methods("POST")
+	router.HandleFunc("/upload/finalize", h.FinalizeUpload).Methods("POST")
+	router.HandleFunc("/media", h.AdminGetAssets).Methods("GET")
+	router.HandleFunc("/media/{id}", h.AdminGetAsset).Methods("GET")
+	router.HandleFunc("/media/{id}", h.AdminDeleteAsset).Methods("DELETE")
 }
 
 // UploadImage handles the image upload request.
 func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form with max 10MB
+	// Cap the body at the largest file any upload type accepts, plus room for the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize(h.types)+1<<20)
+
+	// Parse multipart form with max 10MB in memory
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		RespondWithError(w, http.StatusBadRequest, "Failed to parse form: file too large or invalid format")
 		return
 	}
 
-	// Get the type parameter
+	// Get the type parameter; only registered types may become part of the object path
 	uploadType := r.FormValue("type")
 	if uploadType == "" {
 		RespondWithError(w, http.StatusBadRequest, "Missing required field: type")
 		return
 	}
+	rule, ok := h.types[uploadType]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownType.Error())
+		return
+	}
 
 	// Get the file from the form
 	file, header, err := r.FormFile("file")
@@ -45,10 +66,10 @@ func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate content type
+	// Check the size before reading the file; storeImage checks the rest
 	contentType := header.Header.Get("Content-Type")
-	if !isValidImageType(contentType) {
-		RespondWithError(w, http.StatusBadRequest, "Invalid file type. Allowed types: jpeg, png, gif, webp, svg")
+	if err := rule.checkSize(header.Size); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -59,28 +80,185 @@ func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Upload the image
-	result, err := h.service.UploadImage(r.Context(), fileData, contentType, uploadType)
+	h.storeImage(w, r, rule, uploadType, contentType, fileData)
+}
+
+// SignUpload issues a signed URL so the client can upload a file straight to storage.
+// The body is {"type": "...", "content_type": "...", "size": bytes}.
+func (h *Handler) SignUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type        string `json:"type"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	rule, ok := h.types[req.Type]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownType.Error())
+		return
+	}
+	if !rule.allowsFormat(req.ContentType) {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file type. Allowed types: %s", rule.formatNames()))
+		return
+	}
+	if req.ContentType == "image/svg+xml" && !h.allowSVG {
+		RespondWithError(w, http.StatusBadRequest, ErrSVGNotAllowed.Error())
+		return
+	}
+	if req.Size <= 0 {
+		RespondWithError(w, http.StatusBadRequest, "size is required")
+		return
+	}
+	if err := rule.checkSize(req.Size); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	signed, err := h.service.SignUpload(r.Context(), req.Type, req.ContentType, req.Size)
+	if errors.Is(err, ErrDirectUploadsDisabled) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	RespondWithJSON(w, http.StatusCreated, Response{Data: signed, Message: "success", Code: 0})
+}
+
+// FinalizeUpload checks a file uploaded through a signed URL and stores it like a regular upload.
+// The body is {"id": "...", "type": "..."} as returned by SignUpload.
+func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	rule, ok := h.types[req.Type]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownType.Error())
+		return
+	}
+
+	fileData, contentType, err := h.service.ReadStagedUpload(r.Context(), req.Type, req.ID, rule.MaxSize)
+	if errors.Is(err, ErrUploadNotFound) {
+		RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The staged file is single use; it is only kept after a server error so finalize can be retried
+	if h.storeImage(w, r, rule, req.Type, contentType, fileData) != http.StatusInternalServerError {
+		if err := h.service.DeleteStagedUpload(r.Context(), req.Type, req.ID); err != nil {
+			log.Printf("Failed to delete staged upload %s: %v", req.ID, err)
+		}
+	}
+}
+
+// storeImage validates the file against the rule of its upload type and stores it.
+// It writes the response and returns its status code.
+func (h *Handler) storeImage(w http.ResponseWriter, r *http.Request, rule TypeRule, uploadType, contentType string, fileData []byte) int {
+	if !rule.allowsFormat(contentType) {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file type. Allowed types: %s", rule.formatNames()))
+		return http.StatusBadRequest
+	}
+	if err := rule.checkSize(int64(len(fileData))); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return http.StatusBadRequest
+	}
+
+	// The declared type is set by the client, so the content itself has to agree with it
+	fileData, decoded, err := validateImage(fileData, contentType, rule, h.allowSVG)
+	if errors.Is(err, ErrInvalidImage) || errors.Is(err, ErrTypeMismatch) || errors.Is(err, ErrSVGNotAllowed) || errors.Is(err, ErrImageDimensions) || errors.Is(err, ErrGIFTooLarge) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return http.StatusBadRequest
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return http.StatusInternalServerError
+	}
+
+	// Upload the image
+	result, err := h.service.UploadImage(r.Context(), fileData, decoded, contentType, uploadType)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return http.StatusInternalServerError
+	}
+
 	RespondWithJSON(w, http.StatusCreated, Response{
 		Data:    result,
 		Message: "success",
 		Code:    0,
 	})
+	return http.StatusCreated
+}
+
+func (h *Handler) AdminGetAssets(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := pagination.GetPaginationParams(r)
+	uploadType := r.URL.Query().Get("type")
+
+	assets, totalCount, err := h.service.AdminGetAssets(r.Context(), page, pageSize, uploadType)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	paginator := pagination.New(page, pageSize, totalCount)
+
+	RespondWithJSON(w, http.StatusOK, PaginatedResponse{
+		Data:       assets,
+		Pagination: paginator,
+		Message:    "success",
+		Code:       0,
+	})
 }
 
-// isValidImageType checks if the content type is a valid image type
-func isValidImageType(contentType string) bool {
-	validTypes := map[string]bool{
-		"image/jpeg":    true,
-		"image/png":     true,
-		"image/gif":     true,
-		"image/webp":    true,
-		"image/svg+xml": true,
+func (h *Handler) AdminGetAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	asset, err := h.service.AdminGetAsset(r.Context(), id)
+	if errors.Is(err, ErrAssetNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Asset not found")
+		return
 	}
-	return validTypes[contentType]
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Data: asset, Message: "success", Code: 0})
+}
+
+func (h *Handler) AdminDeleteAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := h.service.AdminDeleteAsset(r.Context(), id)
+	if errors.Is(err, ErrAssetNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Asset not found")
+		return
+	}
+	if errors.Is(err, ErrAssetInUse) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{Message: "success", Code: 0})
 }
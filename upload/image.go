@@ -0,0 +1,253 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// variantSize is a resized copy generated for every raster upload, bounded by MaxSide on its longest side.
+type variantSize struct {
+	Name    string
+	MaxSide int
+}
+
+// variantSizes are the sizes the storefront picks from. Smaller images are never scaled up.
+var variantSizes = []variantSize{
+	{Name: "thumbnail", MaxSide: 200},
+	{Name: "medium", MaxSide: 800},
+	{Name: "large", MaxSide: 1600},
+}
+
+// jpegQuality is used for the JPEG variants. The WebP encoder is lossless, so a WebP variant is only
+// kept when it comes out smaller than the JPEG, which is mostly the case for graphics rather than photos.
+const jpegQuality = 85
+
+// imageFile is one encoded file of a processed upload.
+type imageFile struct {
+	Variant     string
+	Ext         string
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// processedImage is the result of running an upload through the image pipeline.
+type processedImage struct {
+	Width    int
+	Height   int
+	Blurhash string
+	Files    []imageFile
+}
+
+// isProcessable reports whether uploads of this content type are decoded and resized.
+// GIF keeps its animation and SVG is not a raster image, so both are stored as received.
+func isProcessable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	}
+	return false
+}
+
+// processImage applies the EXIF orientation of the upload and encodes every variant as JPEG, and as
+// WebP when that is smaller. src is the upload already decoded, or nil to decode data here.
+// Re-encoding from pixels drops all metadata, EXIF and GPS included.
+func processImage(data []byte, src image.Image) (processedImage, error) {
+	if src == nil {
+		var err error
+		if src, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return processedImage{}, fmt.Errorf("failed to decode image: %w", err)
+		}
+	}
+	img := orient(src, jpegOrientation(data))
+
+	bounds := img.Bounds()
+	result := processedImage{Width: bounds.Dx(), Height: bounds.Dy()}
+
+	for _, size := range variantSizes {
+		resized := resize(img, size.MaxSide)
+		w, h := resized.Bounds().Dx(), resized.Bounds().Dy()
+
+		var jpegBuf bytes.Buffer
+		if err := jpeg.Encode(&jpegBuf, flatten(resized), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return processedImage{}, fmt.Errorf("failed to encode %s jpeg: %w", size.Name, err)
+		}
+
+		// A WebP that fails to encode is skipped; the JPEG is enough on its own.
+		var webpBuf bytes.Buffer
+		if err := encodeWebP(&webpBuf, resized); err != nil {
+			log.Printf("Skipping %s webp: %v", size.Name, err)
+		} else if webpBuf.Len() < jpegBuf.Len() {
+			result.Files = append(result.Files, imageFile{
+				Variant: size.Name, Ext: ".webp", ContentType: "image/webp", Width: w, Height: h, Data: webpBuf.Bytes(),
+			})
+		}
+		result.Files = append(result.Files, imageFile{
+			Variant: size.Name, Ext: ".jpg", ContentType: "image/jpeg", Width: w, Height: h, Data: jpegBuf.Bytes(),
+		})
+	}
+
+	// The placeholder only needs a few pixels, so it is computed from a tiny copy.
+	hash, err := blurhash.Encode(4, 3, resize(img, 32))
+	if err != nil {
+		return processedImage{}, fmt.Errorf("failed to compute blurhash: %w", err)
+	}
+	result.Blurhash = hash
+
+	return result, nil
+}
+
+// encodeWebP encodes img as lossless WebP. The encoder panics on some images with many colors,
+// which is turned into an error.
+func encodeWebP(w io.Writer, img image.Image) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("webp encoder: %v", r)
+		}
+	}()
+	return nativewebp.Encode(w, img, nil)
+}
+
+// resize scales img down so its longest side is at most maxSide.
+func resize(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+	if w >= h {
+		h = max(1, h*maxSide/w)
+		w = maxSide
+	} else {
+		w = max(1, w*maxSide/h)
+		h = maxSide
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// flatten draws img on a white background, since JPEG has no transparency.
+func flatten(img image.Image) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// orient returns img rotated and flipped according to an EXIF orientation value (1-8).
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5-8 swap width and height.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag from a JPEG file.
+// It returns 1 (upright) when the file is not a JPEG or carries no orientation.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all before the image data.
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds tag 0x0112 in the first IFD of a TIFF-structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8 : entry+10]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,229 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// exifJPEG returns the start of a JPEG carrying an EXIF block with the given TIFF data.
+func exifJPEG(tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, 0xFF, 0xDA, 0x00, 0x02)
+}
+
+// byteOrder is what binary.LittleEndian and binary.BigEndian both implement.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// orientationTIFF returns a TIFF block whose first IFD holds an orientation entry.
+func orientationTIFF(order byteOrder, orientation uint16) []byte {
+	var tiff []byte
+	if order == binary.LittleEndian {
+		tiff = []byte("II*\x00")
+	} else {
+		tiff = []byte("MM\x00*")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 2)
+	// An unrelated entry first, then orientation: SHORT, count 1, value padded to four bytes
+	tiff = order.AppendUint16(tiff, 0x010F)
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = order.AppendUint32(tiff, 4)
+	tiff = append(tiff, 'A', 'B', 'C', 0)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	return order.AppendUint32(tiff, 0)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+			if got := jpegOrientation(exifJPEG(orientationTIFF(order, orientation))); got != int(orientation) {
+				t.Errorf("jpegOrientation() %v orientation %d = %d", order, orientation, got)
+			}
+		}
+	}
+
+	valid := orientationTIFF(binary.LittleEndian, 6)
+	withOffset := func(offset uint32) []byte {
+		tiff := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint32(tiff[4:8], offset)
+		return tiff
+	}
+	withCount := func(count uint16) []byte {
+		tiff := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint16(tiff[8:10], count)
+		return tiff
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+		{"no exif", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}},
+		{"segment length past the end", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'}},
+		{"segment length too small", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{"unknown byte order", exifJPEG(append([]byte("XX"), valid[2:]...))},
+		{"short tiff header", exifJPEG(valid[:6])},
+		{"IFD offset past the end", exifJPEG(withOffset(uint32(len(valid))))},
+		{"IFD offset overflowing", exifJPEG(withOffset(0xFFFFFFFF))},
+		{"IFD offset into the header", exifJPEG(withOffset(2))},
+		{"orientation outside the counted entries", exifJPEG(withCount(1))},
+		{"entry count past the end", exifJPEG(withCount(100)[:22])},
+		{"truncated entry", exifJPEG(valid[:len(valid)-10])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != 1 {
+				t.Errorf("jpegOrientation() = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose pixels are numbered row by row:
+	//   1 2 3
+	//   4 5 6
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i + 1)
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		img := orient(src, tt.orientation)
+		var got [][]uint8
+		for y := 0; y < img.Bounds().Dy(); y++ {
+			var row []uint8
+			for x := 0; x < img.Bounds().Dx(); x++ {
+				row = append(row, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+			got = append(got, row)
+		}
+		if !equalRows(got, tt.want) {
+			t.Errorf("orient(%d) = %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+func equalRows(a, b [][]uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessImageFormats(t *testing.T) {
+	// Flat graphics compress far better losslessly; noise does not.
+	flat := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0xFF
+	}
+	noise := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	for i := 3; i < len(noise.Pix); i += 4 {
+		noise.Pix[i] = 0xFF
+	}
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		wantWebP bool
+	}{
+		{"flat graphic", flat, true},
+		{"noisy photo", noise, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := processImage(nil, tt.img)
+			if err != nil {
+				t.Fatalf("processImage() error = %v", err)
+			}
+			jpegs, webps := map[string]imageFile{}, map[string]imageFile{}
+			for _, file := range result.Files {
+				switch file.ContentType {
+				case "image/jpeg":
+					jpegs[file.Variant] = file
+				case "image/webp":
+					webps[file.Variant] = file
+				}
+			}
+			for _, size := range variantSizes {
+				jpegFile, ok := jpegs[size.Name]
+				if !ok {
+					t.Fatalf("no JPEG for %s", size.Name)
+				}
+				webpFile, ok := webps[size.Name]
+				if ok != tt.wantWebP {
+					t.Errorf("WebP for %s = %v, want %v", size.Name, ok, tt.wantWebP)
+				}
+				if ok && len(webpFile.Data) >= len(jpegFile.Data) {
+					t.Errorf("WebP for %s is %d bytes, not smaller than the %d byte JPEG", size.Name, len(webpFile.Data), len(jpegFile.Data))
+				}
+			}
+			// Only the thumbnail is smaller than the upload; images are never scaled up.
+			if f := jpegs["thumbnail"]; f.Width != 200 || f.Height != 150 {
+				t.Errorf("thumbnail is %dx%d, want 200x150", f.Width, f.Height)
+			}
+			if f := jpegs["large"]; f.Width != 400 || f.Height != 300 {
+				t.Errorf("large is %dx%d, want 400x300", f.Width, f.Height)
+			}
+		})
+	}
+}
+
+func TestProcessImageAppliesOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 20)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Insert an EXIF block asking for a 90 degree rotation right after the start of image marker.
+	header := exifJPEG(orientationTIFF(binary.BigEndian, 6))
+	data := append(header[:len(header)-4:len(header)-4], buf.Bytes()[2:]...)
+
+	result, err := processImage(data, nil)
+	if err != nil {
+		t.Fatalf("processImage() error = %v", err)
+	}
+	if result.Width != 20 || result.Height != 40 {
+		t.Errorf("processImage() = %dx%d, want 20x40", result.Width, result.Height)
+	}
+	for _, file := range result.Files {
+		if bytes.Contains(file.Data, []byte("Exif\x00\x00")) {
+			t.Errorf("%s %s still carries EXIF", file.Variant, file.ContentType)
+		}
+	}
+}
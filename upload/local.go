@@ -0,0 +1,218 @@
+package upload
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaDir holds the content type of each stored file; it is never served.
+const metaDir = ".meta"
+
+// LocalBackend stores uploads on the local disk for development. It is also an http.Handler
+// that serves the files and accepts the PUT requests of signed uploads, so the direct upload
+// flow can be tried without a cloud bucket.
+type LocalBackend struct {
+	dir     string
+	baseURL string
+	secret  []byte
+	// private backends only accept signed uploads and never serve their files
+	private bool
+}
+
+// NewLocalBackend creates a backend that writes into dir. baseURL is where the handler is mounted,
+// e.g. http://localhost:8080/files, and is used to build signed upload URLs.
+func NewLocalBackend(dir, baseURL string) (*LocalBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	// Signed URLs only need to survive as long as the process, so the key is generated on start.
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &LocalBackend{dir: dir, baseURL: strings.TrimRight(baseURL, "/"), secret: secret}, nil
+}
+
+// NewLocalStagingBackend creates a backend for staging direct uploads. Its handler accepts signed
+// PUT requests but serves nothing, like a private bucket.
+func NewLocalStagingBackend(dir, baseURL string) (*LocalBackend, error) {
+	b, err := NewLocalBackend(dir, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	b.private = true
+	return b, nil
+}
+
+// filePath maps an object path to a file inside dir, refusing anything that would leave it.
+func (b *LocalBackend) filePath(objectPath string) (string, error) {
+	clean := path.Clean("/" + objectPath)[1:]
+	if clean == "" || clean != objectPath {
+		return "", fmt.Errorf("invalid object path %q", objectPath)
+	}
+	for _, segment := range strings.Split(clean, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("invalid object path %q", objectPath)
+		}
+	}
+	return filepath.Join(b.dir, filepath.FromSlash(clean)), nil
+}
+
+func (b *LocalBackend) metaPath(objectPath string) string {
+	return filepath.Join(b.dir, metaDir, filepath.FromSlash(objectPath))
+}
+
+func (b *LocalBackend) Put(ctx context.Context, objectPath, contentType string, data []byte) error {
+	file, err := b.filePath(objectPath)
+	if err != nil {
+		return err
+	}
+	for name, content := range map[string][]byte{file: data, b.metaPath(objectPath): []byte(contentType)} {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, content, 0o644); err != nil {
+			log.Printf("Failed to write %s: %v", name, err)
+			return fmt.Errorf("failed to write file data: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) Read(ctx context.Context, objectPath string, maxSize int64) ([]byte, string, error) {
+	file, err := b.filePath(objectPath)
+	if err != nil {
+		return nil, "", ErrObjectNotFound
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxSize))
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, err := os.ReadFile(b.metaPath(objectPath))
+	if err != nil {
+		return data, mime.TypeByExtension(path.Ext(objectPath)), nil
+	}
+	return data, string(contentType), nil
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, objectPath string) error {
+	file, err := b.filePath(objectPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{file, b.metaPath(objectPath)} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to delete %s: %v", name, err)
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// SignPut returns a URL to this backend's own handler, signed with an HMAC of the object path,
+// content type, size limit and expiry.
+func (b *LocalBackend) SignPut(ctx context.Context, objectPath, contentType string, size int64, expires time.Time) (string, map[string]string, error) {
+	if _, err := b.filePath(objectPath); err != nil {
+		return "", nil, err
+	}
+	query := url.Values{
+		"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+		"size":      {strconv.FormatInt(size, 10)},
+		"signature": {b.signature(objectPath, contentType, size, expires.Unix())},
+	}
+	return b.baseURL + "/" + objectPath + "?" + query.Encode(), map[string]string{"Content-Type": contentType}, nil
+}
+
+func (b *LocalBackend) signature(objectPath, contentType string, size, expires int64) string {
+	mac := hmac.New(sha256.New, b.secret)
+	fmt.Fprintf(mac, "PUT\n%s\n%s\n%d\n%d", objectPath, contentType, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves stored files on GET and stores signed uploads on PUT. Staged uploads have not
+// been checked yet, so they are never served, even by mistake from a public backend.
+// It expects to be mounted with http.StripPrefix, so the request path is the object path.
+func (b *LocalBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	objectPath := strings.TrimPrefix(r.URL.Path, "/")
+	file, err := b.filePath(objectPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if b.private || strings.HasPrefix(objectPath, "incoming/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeFile(w, r, file)
+	case http.MethodPut:
+		b.servePut(w, r, objectPath)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// servePut checks the signature like a cloud bucket would and stores the request body.
+func (b *LocalBackend) servePut(w http.ResponseWriter, r *http.Request, objectPath string) {
+	query := r.URL.Query()
+	expires, err1 := strconv.ParseInt(query.Get("expires"), 10, 64)
+	size, err2 := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "missing signature", http.StatusForbidden)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	expected := b.signature(objectPath, contentType, size, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		http.Error(w, "signature does not match", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "signed URL has expired", http.StatusForbidden)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, size+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > size {
+		http.Error(w, "file is larger than the signed size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := b.Put(r.Context(), objectPath, contentType, data); err != nil {
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
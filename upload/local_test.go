@@ -0,0 +1,77 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBackendServesNoStagedFiles(t *testing.T) {
+	ctx := context.Background()
+	public, err := NewLocalBackend(t.TempDir(), "http://localhost/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, err := NewLocalStagingBackend(t.TempDir(), "http://localhost/staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*LocalBackend{public, staging} {
+		for _, objectPath := range []string{"product/a.png", "incoming/product/b"} {
+			if err := b.Put(ctx, objectPath, "image/png", []byte("png")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		backend *LocalBackend
+		path    string
+		want    int
+	}{
+		{"public file", public, "/product/a.png", http.StatusOK},
+		{"staged file on the public backend", public, "/incoming/product/b", http.StatusNotFound},
+		{"staging backend", staging, "/product/a.png", http.StatusNotFound},
+		{"staged file on the staging backend", staging, "/incoming/product/b", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				w := httptest.NewRecorder()
+				tt.backend.ServeHTTP(w, httptest.NewRequest(method, tt.path, nil))
+				if w.Code != tt.want {
+					t.Errorf("%s %s = %d, want %d", method, tt.path, w.Code, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalStagingBackendAcceptsSignedPut(t *testing.T) {
+	staging, err := NewLocalStagingBackend(t.TempDir(), "http://localhost/staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedURL, headers, err := staging.SignPut(context.Background(), "incoming/product/c", "image/png", 3, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, strings.TrimPrefix(signedURL, "http://localhost/staging"), strings.NewReader("png"))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	staging.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s, want 200", w.Code, w.Body.String())
+	}
+	data, contentType, err := staging.Read(context.Background(), "incoming/product/c", 10)
+	if err != nil || string(data) != "png" || contentType != "image/png" {
+		t.Errorf("Read() = %q, %q, %v, want the uploaded file", data, contentType, err)
+	}
+}
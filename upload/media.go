@@ -0,0 +1,378 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrAssetNotFound is returned when the requested asset does not exist.
+	ErrAssetNotFound = errors.New("asset not found")
+	// ErrAssetInUse is returned when deleting an asset that is still referenced.
+	ErrAssetInUse = errors.New("asset is still in use")
+	// ErrTooManyOrphans is returned when a purge stops because too many assets look unreferenced.
+	ErrTooManyOrphans = errors.New("too many assets look unreferenced, nothing was purged")
+)
+
+// A purge that would delete more than maxOrphanShare of the eligible assets, and more than
+// minGuardedOrphans of them, is refused: that many orphans at once more likely means references
+// are not being recognized than that the images are unused.
+const (
+	maxOrphanShare    = 0.5
+	minGuardedOrphans = 10
+)
+
+// Asset is the metadata of an uploaded file, stored in the media collection.
+// Objects lists every stored object path so the asset can be removed from the bucket.
+// UploadedAt is bumped when the same file is uploaded again, so a reused asset is not purged as an orphan.
+type Asset struct {
+	ID          string             `json:"id" firestore:"id"`
+	Type        string             `json:"type" firestore:"type"`
+	URL         string             `json:"url" firestore:"url"`
+	ContentType string             `json:"content_type" firestore:"content_type"`
+	Size        int64              `json:"size" firestore:"size"`
+	Hash        string             `json:"hash" firestore:"hash"`
+	Width       int                `json:"width,omitempty" firestore:"width"`
+	Height      int                `json:"height,omitempty" firestore:"height"`
+	Blurhash    string             `json:"blurhash,omitempty" firestore:"blurhash,omitempty"`
+	Variants    map[string]Variant `json:"variants,omitempty" firestore:"variants,omitempty"`
+	Objects     []string           `json:"-" firestore:"objects"`
+	CreatedAt   time.Time          `json:"created_at" firestore:"created_at"`
+	CreatedBy   string             `json:"created_by" firestore:"created_by"`
+	UploadedAt  time.Time          `json:"uploaded_at" firestore:"uploaded_at"`
+	References  []Reference        `json:"references" firestore:"-"`
+}
+
+// Reference is a catalog entry that uses one of the URLs of an asset.
+type Reference struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// URLs returns the main URL and the URLs of every variant.
+func (a Asset) URLs() []string {
+	urls := []string{a.URL}
+	for _, v := range a.Variants {
+		for _, url := range []string{v.WebP, v.JPEG} {
+			if url != "" && url != a.URL {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// result converts the asset into the response of an upload.
+func (a Asset) result() UploadResult {
+	return UploadResult{
+		ID:       a.ID,
+		URL:      a.URL,
+		Type:     a.Type,
+		Width:    a.Width,
+		Height:   a.Height,
+		Blurhash: a.Blurhash,
+		Variants: a.Variants,
+	}
+}
+
+// referenceFields maps each collection that may point at an uploaded image to the field holding the URL.
+var referenceFields = []struct {
+	Kind       string
+	Collection string
+	Field      string
+}{
+	{Kind: "product", Collection: "products", Field: "image_url"},
+	{Kind: "category", Collection: "category", Field: "image"},
+	{Kind: "advertise", Collection: "advertises", Field: "image"},
+	{Kind: "advertise", Collection: "advertises", Field: "mobile_image"},
+}
+
+func (s *StorageService) AdminGetAssets(ctx context.Context, page, pageSize int, uploadType string) ([]Asset, int, error) {
+	var assets []Asset
+	query := s.firestore.Collection(s.collection).Query
+	if uploadType != "" {
+		query = query.Where("type", "==", uploadType)
+	}
+
+	iter := query.Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get assets: %v", err)
+			return nil, 0, err
+		}
+		var asset Asset
+		doc.DataTo(&asset)
+		assets = append(assets, asset)
+	}
+
+	// Newest first, sorted in memory so filtering by type needs no composite index.
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].CreatedAt.After(assets[j].CreatedAt)
+	})
+
+	totalCount := len(assets)
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	if start > totalCount {
+		return []Asset{}, totalCount, nil
+	}
+
+	if end > totalCount {
+		end = totalCount
+	}
+
+	// References are only looked up for the page that is returned.
+	assets = assets[start:end]
+	index, err := s.loadReferences(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range assets {
+		assets[i].References = index.of(assets[i])
+	}
+	return assets, totalCount, nil
+}
+
+func (s *StorageService) AdminGetAsset(ctx context.Context, id string) (Asset, error) {
+	asset, err := s.getAsset(ctx, id)
+	if err != nil {
+		return Asset{}, err
+	}
+	asset.References, err = s.references(ctx, asset)
+	if err != nil {
+		return Asset{}, err
+	}
+	return asset, nil
+}
+
+// AdminDeleteAsset removes the asset and its files, unless something still references it.
+func (s *StorageService) AdminDeleteAsset(ctx context.Context, id string) error {
+	asset, err := s.getAsset(ctx, id)
+	if err != nil {
+		return err
+	}
+	refs, err := s.references(ctx, asset)
+	if err != nil {
+		return err
+	}
+	if len(refs) > 0 {
+		return ErrAssetInUse
+	}
+	return s.deleteAsset(ctx, asset)
+}
+
+// PurgeOrphanAssets deletes assets uploaded before the given time that nothing references, unless
+// that would be too many of them at once. With dryRun nothing is deleted and the orphans are only logged.
+// It returns how many assets were, or with dryRun would have been, purged.
+func (s *StorageService) PurgeOrphanAssets(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	index, err := s.loadReferences(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	iter := s.firestore.Collection(s.collection).Where("created_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	eligible := 0
+	var orphans []Asset
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get assets: %v", err)
+			return 0, err
+		}
+		var asset Asset
+		if err := doc.DataTo(&asset); err != nil {
+			return 0, err
+		}
+		if asset.UploadedAt.After(before) {
+			continue
+		}
+		eligible++
+		if len(index.of(asset)) == 0 {
+			orphans = append(orphans, asset)
+		}
+	}
+
+	if tooManyOrphans(len(orphans), eligible) {
+		log.Printf("Refusing to purge %d of %d media assets", len(orphans), eligible)
+		return 0, ErrTooManyOrphans
+	}
+	if dryRun {
+		for _, asset := range orphans {
+			log.Printf("Would purge orphan media asset %s (%s)", asset.ID, asset.URL)
+		}
+		return len(orphans), nil
+	}
+
+	purged := 0
+	for _, asset := range orphans {
+		if err := s.deleteAsset(ctx, asset); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// tooManyOrphans reports whether purging orphans of the eligible assets is refused.
+func tooManyOrphans(orphans, eligible int) bool {
+	return orphans > minGuardedOrphans && float64(orphans) > maxOrphanShare*float64(eligible)
+}
+
+// findAssetByHash returns the asset of this type with the same content, if one was uploaded before.
+// Assets recorded before hashing was introduced have no hash and are never matched.
+func (s *StorageService) findAssetByHash(ctx context.Context, uploadType, hash string) (Asset, bool, error) {
+	docs, err := s.firestore.Collection(s.collection).Where("type", "==", uploadType).Where("hash", "==", hash).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to look up asset by hash: %v", err)
+		return Asset{}, false, err
+	}
+	if len(docs) == 0 {
+		return Asset{}, false, nil
+	}
+	var asset Asset
+	if err := docs[0].DataTo(&asset); err != nil {
+		return Asset{}, false, err
+	}
+
+	asset.UploadedAt = time.Now()
+	if _, err := docs[0].Ref.Update(ctx, []firestore.Update{{Path: "uploaded_at", Value: asset.UploadedAt}}); err != nil {
+		log.Printf("Failed to update asset %s: %v", asset.ID, err)
+		return Asset{}, false, err
+	}
+	return asset, true, nil
+}
+
+// saveAsset records the metadata of a finished upload.
+func (s *StorageService) saveAsset(ctx context.Context, asset Asset) error {
+	if _, err := s.firestore.Collection(s.collection).Doc(asset.ID).Set(ctx, asset); err != nil {
+		log.Printf("Failed to save asset: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *StorageService) getAsset(ctx context.Context, id string) (Asset, error) {
+	doc, err := s.firestore.Collection(s.collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Asset{}, ErrAssetNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to get asset: %v", err)
+		return Asset{}, err
+	}
+	var asset Asset
+	if err := doc.DataTo(&asset); err != nil {
+		return Asset{}, err
+	}
+	return asset, nil
+}
+
+// deleteAsset removes the files first, so a failure leaves the metadata behind to retry with.
+func (s *StorageService) deleteAsset(ctx context.Context, asset Asset) error {
+	for _, objectPath := range asset.Objects {
+		if err := s.backend.Delete(ctx, objectPath); err != nil {
+			return err
+		}
+	}
+	if _, err := s.firestore.Collection(s.collection).Doc(asset.ID).Delete(ctx); err != nil {
+		log.Printf("Failed to delete asset %s: %v", asset.ID, err)
+		return err
+	}
+	return nil
+}
+
+// references finds the products, categories and advertises that use any file of the asset.
+func (s *StorageService) references(ctx context.Context, asset Asset) ([]Reference, error) {
+	index, err := s.loadReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return index.of(asset), nil
+}
+
+// referenceIndex maps object paths to the catalog entries whose image URLs point at them.
+type referenceIndex map[string][]Reference
+
+// loadReferences reads the image fields of every catalog entry. Entries in the trash count as well,
+// since they can still be restored.
+func (s *StorageService) loadReferences(ctx context.Context) (referenceIndex, error) {
+	index := referenceIndex{}
+	for _, rf := range referenceFields {
+		docs, err := s.firestore.Collection(rf.Collection).Select(rf.Field, "name").Documents(ctx).GetAll()
+		if err != nil {
+			log.Printf("Failed to find %s references: %v", rf.Kind, err)
+			return nil, err
+		}
+		for _, doc := range docs {
+			link, _ := doc.Data()[rf.Field].(string)
+			if link == "" {
+				continue
+			}
+			name, _ := doc.Data()["name"].(string)
+			ref := Reference{Kind: rf.Kind, ID: doc.Ref.ID, Name: name}
+			for _, objectPath := range objectPaths(link) {
+				index[objectPath] = append(index[objectPath], ref)
+			}
+		}
+	}
+	return index, nil
+}
+
+// of lists the entries using any object of the asset. An entry using the asset in more than one
+// field is listed once.
+func (index referenceIndex) of(asset Asset) []Reference {
+	keys := slices.Clone(asset.Objects)
+	for _, link := range asset.URLs() {
+		keys = append(keys, objectPaths(link)...)
+	}
+
+	refs := []Reference{}
+	seen := map[Reference]bool{}
+	for _, key := range keys {
+		for _, ref := range index[key] {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// objectPaths returns the object paths a URL may point at, whatever base URL it was built with.
+// Objects are stored as type/id.ext or type/id/variant.ext, so those are the last two or three
+// segments of the URL path.
+func objectPaths(rawURL string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	var paths []string
+	for n := 2; n <= 3 && n <= len(segments); n++ {
+		paths = append(paths, strings.Join(segments[len(segments)-n:], "/"))
+	}
+	return paths
+}
@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObjectPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want []string
+	}{
+		{"cloud storage", "https://storage.googleapis.com/shop.appspot.com/product/a.jpg", []string{"product/a.jpg", "shop.appspot.com/product/a.jpg"}},
+		{"variant", "https://cdn.example.com/product/a/medium.webp", []string{"a/medium.webp", "product/a/medium.webp"}},
+		{"query and trailing slash", "http://localhost:8080/files/product/a.jpg/?v=2", []string{"product/a.jpg", "files/product/a.jpg"}},
+		{"single segment", "https://cdn.example.com/a.jpg", nil},
+		{"relative", "product/a.jpg", []string{"product/a.jpg"}},
+		{"not a URL", "http://[::1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectPaths(tt.url); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("objectPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReferenceIndexOf(t *testing.T) {
+	product := Reference{Kind: "product", ID: "p1", Name: "Tea"}
+	banner := Reference{Kind: "advertise", ID: "a1", Name: "Sale"}
+	other := Reference{Kind: "product", ID: "p2", Name: "Cake"}
+
+	// Entries are indexed from the URLs they hold, which may use another base URL than the asset.
+	index := referenceIndex{}
+	for link, ref := range map[string]Reference{
+		"https://cdn.example.com/product/a/large.jpg":   product,
+		"https://old-bucket.example.com/product/a.png":  banner,
+		"https://cdn.example.com/product/a/medium.webp": banner,
+		"https://cdn.example.com/product/b.png":         other,
+	} {
+		for _, objectPath := range objectPaths(link) {
+			index[objectPath] = append(index[objectPath], ref)
+		}
+	}
+
+	asset := Asset{
+		URL: "https://storage.googleapis.com/shop/product/a.png",
+		Variants: map[string]Variant{
+			"medium": {WebP: "https://storage.googleapis.com/shop/product/a/medium.webp", JPEG: "https://storage.googleapis.com/shop/product/a/medium.jpg"},
+		},
+		Objects: []string{"product/a.png", "product/a/medium.webp", "product/a/medium.jpg", "product/a/large.jpg"},
+	}
+
+	tests := []struct {
+		name  string
+		asset Asset
+		want  []Reference
+	}{
+		{"variant, original and the same entry twice", asset, []Reference{banner, product}},
+		{"found through the objects alone", Asset{Objects: []string{"product/a/large.jpg"}}, []Reference{product}},
+		{"found through the URL alone", Asset{URL: "https://x.example.com/product/b.png"}, []Reference{other}},
+		{"unreferenced", Asset{URL: "https://cdn.example.com/product/c.png", Objects: []string{"product/c.png"}}, []Reference{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := index.of(tt.asset); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("of() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTooManyOrphans(t *testing.T) {
+	tests := []struct {
+		orphans, eligible int
+		want              bool
+	}{
+		{0, 0, false},
+		{minGuardedOrphans, minGuardedOrphans, false},
+		{minGuardedOrphans + 1, minGuardedOrphans + 1, true},
+		{50, 100, false},
+		{51, 100, true},
+		{5, 6, false},
+	}
+	for _, tt := range tests {
+		if got := tooManyOrphans(tt.orphans, tt.eligible); got != tt.want {
+			t.Errorf("tooManyOrphans(%d, %d) = %v, want %v", tt.orphans, tt.eligible, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is used as the payload hash of presigned URLs, whose body is not known in advance.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Backend stores uploads in an S3-compatible bucket such as AWS S3 or MinIO.
+// Requests are signed with AWS Signature Version 4 and use path-style URLs: <endpoint>/<bucket>/<key>.
+type S3Backend struct {
+	endpoint        string
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	httpClient      *http.Client
+}
+
+// NewS3Backend creates a backend for bucket at endpoint, e.g. http://localhost:9000 for a local MinIO.
+func NewS3Backend(endpoint, region, bucket, accessKeyID, secretAccessKey string) *S3Backend {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Backend{
+		endpoint:        strings.TrimRight(endpoint, "/"),
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		httpClient:      &http.Client{Timeout: time.Minute},
+	}
+}
+
+// objectURL returns the path-style URL of an object.
+func (b *S3Backend) objectURL(objectPath string) (*url.URL, error) {
+	return url.Parse(b.endpoint + "/" + b.bucket + "/" + uriEncode(objectPath, false))
+}
+
+func (b *S3Backend) Put(ctx context.Context, objectPath, contentType string, data []byte) error {
+	resp, err := b.do(ctx, http.MethodPut, objectPath, data, map[string]string{
+		"Content-Type":  contentType,
+		"Cache-Control": "public, max-age=31536000, immutable",
+	})
+	if err != nil {
+		log.Printf("Failed to write file data: %v", err)
+		return fmt.Errorf("failed to write file data: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", objectPath, resp)
+	}
+	return nil
+}
+
+func (b *S3Backend) Read(ctx context.Context, objectPath string, maxSize int64) ([]byte, string, error) {
+	resp, err := b.do(ctx, http.MethodGet, objectPath, nil, nil)
+	if err != nil {
+		log.Printf("Failed to open object %s: %v", objectPath, err)
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrObjectNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", s3Error("get", objectPath, resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize))
+	if err != nil {
+		log.Printf("Failed to read object %s: %v", objectPath, err)
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, objectPath string) error {
+	resp, err := b.do(ctx, http.MethodDelete, objectPath, nil, nil)
+	if err != nil {
+		log.Printf("Failed to delete object %s: %v", objectPath, err)
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	defer resp.Body.Close()
+	// S3 answers 204 whether or not the object existed.
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", objectPath, resp)
+	}
+	return nil
+}
+
+// SignPut returns a presigned PUT URL. Presigned URLs cannot carry a size range, so the exact
+// Content-Length is signed instead and the client has to upload exactly size bytes.
+func (b *S3Backend) SignPut(ctx context.Context, objectPath, contentType string, size int64, expires time.Time) (string, map[string]string, error) {
+	u, err := b.objectURL(objectPath)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	seconds := int64(time.Until(expires).Seconds())
+	if seconds < 1 {
+		return "", nil, fmt.Errorf("signed URL expiry must be in the future")
+	}
+
+	headers := map[string]string{
+		"Content-Type":   contentType,
+		"Content-Length": strconv.FormatInt(size, 10),
+	}
+	signed := map[string]string{"host": u.Host}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = value
+	}
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", b.accessKeyID+"/"+b.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(seconds, 10))
+	query.Set("X-Amz-SignedHeaders", signedHeaderNames(signed))
+
+	signature := b.signature(now, http.MethodPut, u.EscapedPath(), query, signed, unsignedPayload)
+	query.Set("X-Amz-Signature", signature)
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), headers, nil
+}
+
+// do sends a request signed in the Authorization header.
+func (b *S3Backend) do(ctx context.Context, method, objectPath string, body []byte, headers map[string]string) (*http.Response, error) {
+	u, err := b.objectURL(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	payloadHash := sha256Hex(body)
+	signed := map[string]string{
+		"host":                 u.Host,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+		"x-amz-content-sha256": payloadHash,
+	}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = value
+	}
+	for name, value := range signed {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	signature := b.signature(now, method, u.EscapedPath(), url.Values{}, signed, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKeyID, b.scope(now), signedHeaderNames(signed), signature))
+	return b.httpClient.Do(req)
+}
+
+// scope is the credential scope of a signature made at t.
+func (b *S3Backend) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + b.region + "/s3/aws4_request"
+}
+
+// signature computes a Signature Version 4 signature over the canonical request.
+func (b *S3Backend) signature(t time.Time, method, escapedPath string, query url.Values, headers map[string]string, payloadHash string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		b.scope(t),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretAccessKey), t.Format("20060102"))
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery sorts the parameters and encodes them the way Signature Version 4 expects.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signedHeaderNames lists the lowercase header names in sorted order, separated by semicolons.
+func signedHeaderNames(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// uriEncode percent-encodes everything except the unreserved characters; slashes are kept
+// unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var out strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			out.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Error turns an unexpected S3 response into an error, keeping the start of the XML error body.
+func s3Error(op, objectPath string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	log.Printf("S3 %s %s failed: %s %s", op, objectPath, resp.Status, body)
+	return fmt.Errorf("s3 %s failed: %s", op, resp.Status)
+}
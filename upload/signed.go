@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// signedUploadExpiry is how long a signed upload URL stays valid.
+const signedUploadExpiry = 15 * time.Minute
+
+var (
+	// ErrUploadNotFound is returned when finalizing an upload whose file was never stored.
+	ErrUploadNotFound = errors.New("uploaded file not found")
+	// ErrDirectUploadsDisabled is returned when no private staging storage is configured.
+	ErrDirectUploadsDisabled = errors.New("direct uploads are not enabled")
+)
+
+// SignedUpload tells the client where to PUT a file directly. The headers must be sent as given,
+// since they are part of the signature.
+type SignedUpload struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// stagedUpload records a signed upload in the staged_uploads collection, so the files that are
+// never finalized can be swept once their URL has expired.
+type stagedUpload struct {
+	Type      string    `firestore:"type"`
+	Object    string    `firestore:"object"`
+	ExpiresAt time.Time `firestore:"expires_at"`
+}
+
+// stagedObjectPath is where a direct upload waits in the private staging backend until it is finalized.
+// The ID must be a UUID so a client cannot point finalize at any other object.
+func stagedObjectPath(uploadType, id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", ErrUploadNotFound
+	}
+	return fmt.Sprintf("incoming/%s/%s", uploadType, id), nil
+}
@@ -0,0 +1,261 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrInvalidImage is returned when the file content is not a valid image.
+	ErrInvalidImage = errors.New("file is not a valid image")
+	// ErrTypeMismatch is returned when the file content does not match the declared Content-Type.
+	ErrTypeMismatch = errors.New("file content does not match its Content-Type")
+	// ErrSVGNotAllowed is returned for SVG uploads unless they have been enabled.
+	ErrSVGNotAllowed = errors.New("svg uploads are not enabled")
+	// ErrGIFTooLarge is returned for animations with too many frames or pixels to decode safely.
+	ErrGIFTooLarge = fmt.Errorf("gif has too many frames or pixels, at most %d frames and %d pixels in total", maxGIFFrames, maxGIFPixels)
+)
+
+// Decoding a GIF allocates every frame at one byte per pixel, so animations are capped on both counts.
+const (
+	maxGIFFrames = 300
+	maxGIFPixels = 64 << 20
+)
+
+// sniffContentType detects the real type of an upload from its first bytes.
+// It returns an empty string when the content is not one of the supported image formats.
+func sniffContentType(data []byte) string {
+	switch detected := http.DetectContentType(data); detected {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return detected
+	}
+	if isSVG(data) {
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// isSVG reports whether the root element of the document is <svg>.
+func isSVG(data []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Space == "" && start.Name.Local == "svg"
+		}
+	}
+}
+
+// validateImage checks the upload against its declared Content-Type and the rule of its upload type,
+// and returns the data to store. Raster images must be within the dimension limits and decode;
+// the decoded image is returned too, so processing does not decode it again. It is nil for GIF,
+// which is stored as received, and for SVG, which is only accepted when allowSVG is set and is sanitized first.
+func validateImage(data []byte, contentType string, rule TypeRule, allowSVG bool) ([]byte, image.Image, error) {
+	detected := sniffContentType(data)
+	if detected == "" {
+		return nil, nil, ErrInvalidImage
+	}
+	if detected != contentType {
+		return nil, nil, ErrTypeMismatch
+	}
+
+	if detected == "image/svg+xml" {
+		if !allowSVG {
+			return nil, nil, ErrSVGNotAllowed
+		}
+		sanitized, err := sanitizeSVG(data)
+		return sanitized, nil, err
+	}
+
+	// Dimensions come from the header, so oversized images are rejected before any pixels are allocated.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if err := rule.checkDimensions(config.Width, config.Height); err != nil {
+		return nil, nil, err
+	}
+
+	if detected == "image/gif" {
+		// GIFs are stored as received, so every frame is checked here, once the frame headers show
+		// that decoding them all fits in memory.
+		frames, pixels, err := gifFrames(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+		if frames > maxGIFFrames || pixels > maxGIFPixels {
+			return nil, nil, ErrGIFTooLarge
+		}
+		if _, err := gif.DecodeAll(bytes.NewReader(data)); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+		return data, nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	return data, img, nil
+}
+
+// gifFrames walks the blocks of a GIF without decoding any pixels, and returns the number of frames
+// and the sum of their areas.
+func gifFrames(data []byte) (int, int64, error) {
+	errTruncated := errors.New("truncated gif")
+	// Header and logical screen descriptor, then the optional global color table.
+	if len(data) < 13 {
+		return 0, 0, errTruncated
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << ((flags & 0x07) + 1)
+	}
+
+	// skipSubBlocks moves past a chain of length-prefixed sub-blocks ending in an empty one.
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(data) {
+				return errTruncated
+			}
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames, pixels := 0, int64(0)
+	for {
+		if i >= len(data) {
+			return 0, 0, errTruncated
+		}
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x2C: // image descriptor, optional local color table, LZW code size, then sub-blocks
+			if i+10 > len(data) {
+				return 0, 0, errTruncated
+			}
+			width := int64(binary.LittleEndian.Uint16(data[i+5 : i+7]))
+			height := int64(binary.LittleEndian.Uint16(data[i+7 : i+9]))
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << ((flags & 0x07) + 1)
+			}
+			i++
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+			frames++
+			pixels += width * height
+			// Stop early rather than walking a huge file that is rejected anyway.
+			if frames > maxGIFFrames || pixels > maxGIFPixels {
+				return frames, pixels, nil
+			}
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, fmt.Errorf("unknown gif block 0x%02x", data[i])
+		}
+	}
+}
+
+// svgBlockedElements are dropped from SVG uploads together with everything inside them.
+var svgBlockedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// sanitizeSVG rewrites an SVG keeping only plain markup: scripts, foreign objects, event handler
+// attributes, javascript: links, comments, processing instructions and DOCTYPEs are removed.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+
+	skipDepth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 || svgBlockedElements[strings.ToLower(t.Name.Local)] {
+				skipDepth++
+				continue
+			}
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !isSafeSVGAttr(attr) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth == 0 {
+				xml.EscapeText(&out, t)
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// isSafeSVGAttr rejects event handlers and values that could run script, including ones set through <animate>.
+func isSafeSVGAttr(attr xml.Attr) bool {
+	if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+		return false
+	}
+	value := strings.Join(strings.Fields(strings.ToLower(attr.Value)), "")
+	if strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:") {
+		return false
+	}
+	if strings.HasPrefix(value, "data:") {
+		// Embedded raster images are fine; an embedded SVG or HTML document is not.
+		return strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg")
+	}
+	return true
+}
+
+// qualifiedName writes back a name as it appeared in the document, prefix included.
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
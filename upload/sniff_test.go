@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"plain markup", `<svg viewBox="0 0 1 1"><rect width="1"/></svg>`, `<svg viewBox="0 0 1 1"><rect width="1"></rect></svg>`, false},
+		{"script", `<svg><script>alert(1)</script><rect/></svg>`, `<svg><rect></rect></svg>`, false},
+		{"script in upper case", `<svg><SCRIPT>alert(1)</SCRIPT></svg>`, `<svg></svg>`, false},
+		{"script in a namespace", `<svg xmlns:x="http://www.w3.org/2000/svg"><x:script>alert(1)</x:script></svg>`, `<svg xmlns:x="http://www.w3.org/2000/svg"></svg>`, false},
+		{"event handlers", `<svg onload="alert(1)"><rect OnClick="alert(1)" fill="red"/></svg>`, `<svg><rect fill="red"></rect></svg>`, false},
+		{"javascript href", `<svg><a href="javascript:alert(1)">x</a></svg>`, `<svg><a>x</a></svg>`, false},
+		{"javascript xlink href with whitespace", `<svg><a xlink:href=" Java	Script:alert(1)">x</a></svg>`, `<svg><a>x</a></svg>`, false},
+		{"javascript set through animation", `<svg><set attributeName="href" to="javascript:alert(1)"/></svg>`, `<svg><set attributeName="href"></set></svg>`, false},
+		{"vbscript href", `<svg><a href="vbscript:msgbox(1)">x</a></svg>`, `<svg><a>x</a></svg>`, false},
+		{"foreign object", `<svg><foreignObject><body onload="alert(1)"><p>x</p></body></foreignObject><rect/></svg>`, `<svg><rect></rect></svg>`, false},
+		{"embedded svg document", `<svg><image href="data:image/svg+xml;base64,PHN2Zz4="/></svg>`, `<svg><image></image></svg>`, false},
+		{"embedded html document", `<svg><image href="data:text/html;base64,PHNjcmlwdD4="/></svg>`, `<svg><image></image></svg>`, false},
+		{"embedded raster image", `<svg><image href="data:image/png;base64,AAAA"/></svg>`, `<svg><image href="data:image/png;base64,AAAA"></image></svg>`, false},
+		{"character reference in href", `<svg><a href="&#106;avascript:alert(1)">x</a></svg>`, `<svg><a>x</a></svg>`, false},
+		{"escaped markup stays text", `<svg><text>&lt;script&gt;alert(1)&lt;/script&gt;</text></svg>`, `<svg><text>&lt;script&gt;alert(1)&lt;/script&gt;</text></svg>`, false},
+		{"cdata becomes text", `<svg><![CDATA[<script>alert(1)</script>]]></svg>`, `<svg>&lt;script&gt;alert(1)&lt;/script&gt;</svg>`, false},
+		{"comments and processing instructions", `<svg><!-- x --><?xml-stylesheet href="x.css"?></svg>`, `<svg></svg>`, false},
+		{"entity declared in the doctype", `<!DOCTYPE svg [<!ENTITY x "javascript:alert(1)">]><svg><a href="&x;">x</a></svg>`, "", true},
+		{"external entity", `<!DOCTYPE svg [<!ENTITY x SYSTEM "file:///etc/passwd">]><svg><text>&x;</text></svg>`, "", true},
+		{"not xml", `<svg><a href="x></svg>`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeSVG([]byte(tt.in))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidImage) {
+					t.Fatalf("sanitizeSVG() error = %v, want ErrInvalidImage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeSVG() error = %v", err)
+			}
+			if got := strings.TrimPrefix(string(got), `<?xml version="1.0" encoding="UTF-8"?>`+"\n"); got != tt.want {
+				t.Errorf("sanitizeSVG() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// encodeGIF returns an animation of the given number of frames, each w by h pixels.
+func encodeGIF(t *testing.T, frames, w, h int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for n := 0; n < frames; n++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, w, h), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugeFrameGIF is a 1x1 GIF whose single frame claims to be 65535x65535 pixels.
+func hugeFrameGIF() []byte {
+	data := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00")
+	descriptor := make([]byte, 10)
+	descriptor[0] = 0x2C
+	binary.LittleEndian.PutUint16(descriptor[5:], 0xFFFF)
+	binary.LittleEndian.PutUint16(descriptor[7:], 0xFFFF)
+	data = append(data, descriptor...)
+	// LZW code size, an empty chain of sub-blocks and the trailer
+	return append(data, 0x02, 0x00, 0x3B)
+}
+
+func TestGIFFrames(t *testing.T) {
+	three := encodeGIF(t, 3, 4, 2)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantFrames int
+		wantPixels int64
+		wantErr    bool
+	}{
+		{"animation", three, 3, 24, false},
+		{"too many frames stops early", encodeGIF(t, maxGIFFrames+5, 1, 1), maxGIFFrames + 1, maxGIFFrames + 1, false},
+		{"huge frame", hugeFrameGIF(), 1, 0xFFFF * 0xFFFF, false},
+		{"empty", nil, 0, 0, true},
+		{"cut in the header", three[:10], 0, 0, true},
+		{"cut in the color table", three[:16], 0, 0, true},
+		{"cut in a frame", three[:len(three)/2], 0, 0, true},
+		{"no trailer", three[:len(three)-1], 0, 0, true},
+		{"unknown block", append(append([]byte(nil), three[:len(three)-1]...), 0x00), 0, 0, true},
+		{"sub-block runs past the end", append(append([]byte(nil), three[:len(three)-1]...), 0x21, 0xF9, 0xFF, 0x00), 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, pixels, err := gifFrames(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gifFrames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if frames != tt.wantFrames || pixels != tt.wantPixels {
+				t.Errorf("gifFrames() = %d frames, %d pixels, want %d, %d", frames, pixels, tt.wantFrames, tt.wantPixels)
+			}
+		})
+	}
+}
+
+func TestValidateImageGIF(t *testing.T) {
+	rule := TypeRule{Formats: []string{"image/gif"}}
+	valid := encodeGIF(t, 3, 4, 2)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"animation", valid, nil},
+		{"too many frames", encodeGIF(t, maxGIFFrames+1, 1, 1), ErrGIFTooLarge},
+		{"too many pixels", hugeFrameGIF(), ErrGIFTooLarge},
+		{"truncated", valid[:len(valid)-1], ErrInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, decoded, err := validateImage(tt.data, "image/gif", rule, false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validateImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (!bytes.Equal(got, tt.data) || decoded != nil) {
+				t.Errorf("validateImage() should return the GIF as received and no decoded image")
+			}
+		})
+	}
+}
@@ -1,90 +1,233 @@
 package upload
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"log"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"cloud.google.com/go/firestore"
 	"github.com/google/uuid"
+	"google.golang.org/api/iterator"
+	"suto-e-shop-api/auth"
 )
 
-// StorageService is a Firebase Storage implementation of the upload service.
+// StorageService is the upload service. Files are kept in a Backend and asset metadata
+// in the Firestore media collection.
 type StorageService struct {
-	client     *storage.Client
-	bucketName string
+	backend           Backend
+	staging           Backend
+	publicBaseURL     string
+	firestore         *firestore.Client
+	collection        string
+	stagingCollection string
 }
 
-// NewStorageService creates a new Storage-backed upload service.
-func NewStorageService(client *storage.Client, bucketName string) *StorageService {
+// NewStorageService creates a new upload service. publicBaseURL is where the backend's objects
+// are publicly served from, e.g. https://storage.googleapis.com/<bucket>. staging keeps direct
+// uploads until they are finalized and must not be publicly readable, since its files have not been
+// checked yet; without it direct uploads are disabled.
+func NewStorageService(backend, staging Backend, publicBaseURL string, firestoreClient *firestore.Client) *StorageService {
 	return &StorageService{
-		client:     client,
-		bucketName: bucketName,
+		backend:           backend,
+		staging:           staging,
+		publicBaseURL:     strings.TrimRight(publicBaseURL, "/"),
+		firestore:         firestoreClient,
+		collection:        "media",
+		stagingCollection: "staged_uploads",
 	}
 }
 
-func (s *StorageService) UploadImage(ctx context.Context, fileData []byte, contentType string, uploadType string) (UploadResult, error) {
+func (s *StorageService) UploadImage(ctx context.Context, fileData []byte, decoded image.Image, contentType string, uploadType string) (UploadResult, error) {
+	// The same file uploaded again under the same type reuses the stored asset.
+	// Two identical uploads racing each other may still both be stored.
+	sum := sha256.Sum256(fileData)
+	hash := hex.EncodeToString(sum[:])
+	existing, found, err := s.findAssetByHash(ctx, uploadType, hash)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if found {
+		result := existing.result()
+		result.Duplicate = true
+		return result, nil
+	}
+
 	// Generate a unique ID for the file
 	id := uuid.New().String()
-
-	// Determine file extension based on content type
-	ext := getFileExtension(contentType)
-
-	// Create the object path: type/id.ext
-	objectPath := fmt.Sprintf("%s/%s%s", uploadType, id, ext)
-
-	// Get bucket handle
-	bucket := s.client.Bucket(s.bucketName)
-
-	// Create object handle
-	obj := bucket.Object(objectPath)
-
-	// Create a writer for the object
-	writer := obj.NewWriter(ctx)
-	writer.ContentType = contentType
-
-	// Write the file data
-	if _, err := writer.Write(fileData); err != nil {
-		log.Printf("Failed to write file data: %v", err)
-		return UploadResult{}, fmt.Errorf("failed to write file data: %w", err)
+	asset := Asset{
+		ID:          id,
+		Type:        uploadType,
+		ContentType: contentType,
+		Size:        int64(len(fileData)),
+		Hash:        hash,
+		CreatedAt:   time.Now(),
+		CreatedBy:   auth.Actor(ctx),
+	}
+	asset.UploadedAt = asset.CreatedAt
+
+	if !isProcessable(contentType) {
+		// Create the object path: type/id.ext
+		objectPath := fmt.Sprintf("%s/%s%s", uploadType, id, getFileExtension(contentType))
+		if err := s.backend.Put(ctx, objectPath, contentType, fileData); err != nil {
+			return UploadResult{}, err
+		}
+		asset.Objects = append(asset.Objects, objectPath)
+		if config, _, err := image.DecodeConfig(bytes.NewReader(fileData)); err == nil {
+			asset.Width, asset.Height = config.Width, config.Height
+		}
+		asset.URL = s.publicURL(objectPath)
+	} else {
+		processed, err := processImage(fileData, decoded)
+		if err != nil {
+			log.Printf("Failed to process image: %v", err)
+			return UploadResult{}, err
+		}
+		asset.Width, asset.Height, asset.Blurhash = processed.Width, processed.Height, processed.Blurhash
+		asset.Variants = make(map[string]Variant, len(variantSizes))
+
+		// Variants are stored as type/id/variant.ext; the original file is not kept.
+		for _, file := range processed.Files {
+			objectPath := fmt.Sprintf("%s/%s/%s%s", uploadType, id, file.Variant, file.Ext)
+			if err := s.backend.Put(ctx, objectPath, file.ContentType, file.Data); err != nil {
+				return UploadResult{}, err
+			}
+			asset.Objects = append(asset.Objects, objectPath)
+
+			variant := asset.Variants[file.Variant]
+			variant.Width, variant.Height = file.Width, file.Height
+			url := s.publicURL(objectPath)
+			if file.ContentType == "image/webp" {
+				variant.WebP = url
+			} else {
+				variant.JPEG = url
+			}
+			asset.Variants[file.Variant] = variant
+		}
+		asset.URL = asset.Variants["large"].JPEG
 	}
 
-	// Close the writer to finalize the upload
-	if err := writer.Close(); err != nil {
-		log.Printf("Failed to close writer: %v", err)
-		return UploadResult{}, fmt.Errorf("failed to close writer: %w", err)
+	if err := s.saveAsset(ctx, asset); err != nil {
+		return UploadResult{}, err
 	}
+	return asset.result(), nil
+}
 
-	// Make the object publicly readable
-	if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-		log.Printf("Failed to set ACL: %v", err)
-		return UploadResult{}, fmt.Errorf("failed to set ACL: %w", err)
+// SignUpload issues a URL the client can PUT the file to; FinalizeUpload picks it up from there.
+func (s *StorageService) SignUpload(ctx context.Context, uploadType, contentType string, size int64) (SignedUpload, error) {
+	if s.staging == nil {
+		return SignedUpload{}, ErrDirectUploadsDisabled
+	}
+	id := uuid.New().String()
+	objectPath, err := stagedObjectPath(uploadType, id)
+	if err != nil {
+		return SignedUpload{}, err
 	}
 
-	// Generate the public URL: /type/filename.ext
-	url := fmt.Sprintf("/%s", objectPath)
+	expiresAt := time.Now().Add(signedUploadExpiry)
+	url, headers, err := s.staging.SignPut(ctx, objectPath, contentType, size, expiresAt)
+	if err != nil {
+		return SignedUpload{}, err
+	}
+	record := stagedUpload{Type: uploadType, Object: objectPath, ExpiresAt: expiresAt}
+	if _, err := s.firestore.Collection(s.stagingCollection).Doc(id).Set(ctx, record); err != nil {
+		log.Printf("Failed to record staged upload %s: %v", id, err)
+		return SignedUpload{}, err
+	}
 
-	return UploadResult{
-		ID:   id,
-		URL:  url,
-		Type: uploadType,
+	return SignedUpload{
+		ID:        id,
+		Type:      uploadType,
+		URL:       url,
+		Method:    "PUT",
+		Headers:   headers,
+		ExpiresAt: expiresAt,
 	}, nil
 }
 
-// GetSignedURL generates a signed URL for the object (optional, for private access)
-func (s *StorageService) GetSignedURL(ctx context.Context, objectPath string, expiration time.Duration) (string, error) {
-	opts := &storage.SignedURLOptions{
-		Method:  "GET",
-		Expires: time.Now().Add(expiration),
+// ReadStagedUpload returns a directly uploaded file and the content type it was stored with.
+// At most maxSize+1 bytes are read, so the caller can tell an oversized file apart.
+func (s *StorageService) ReadStagedUpload(ctx context.Context, uploadType, id string, maxSize int64) ([]byte, string, error) {
+	if s.staging == nil {
+		return nil, "", ErrUploadNotFound
+	}
+	objectPath, err := stagedObjectPath(uploadType, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, contentType, err := s.staging.Read(ctx, objectPath, maxSize+1)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, "", ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, "", err
 	}
+	return data, contentType, nil
+}
 
-	url, err := s.client.Bucket(s.bucketName).SignedURL(objectPath, opts)
+// DeleteStagedUpload removes a directly uploaded file once it has been finalized or rejected.
+func (s *StorageService) DeleteStagedUpload(ctx context.Context, uploadType, id string) error {
+	if s.staging == nil {
+		return ErrUploadNotFound
+	}
+	objectPath, err := stagedObjectPath(uploadType, id)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate signed URL: %w", err)
+		return err
+	}
+	if err := s.staging.Delete(ctx, objectPath); err != nil {
+		return err
+	}
+	_, err = s.firestore.Collection(s.stagingCollection).Doc(id).Delete(ctx)
+	return err
+}
+
+// PurgeExpiredUploads deletes the staged files whose signed URL expired before the given time
+// without being finalized.
+func (s *StorageService) PurgeExpiredUploads(ctx context.Context, before time.Time) (int, error) {
+	if s.staging == nil {
+		return 0, nil
 	}
+	iter := s.firestore.Collection(s.stagingCollection).Where("expires_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	purged := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to get staged uploads: %v", err)
+			return purged, err
+		}
+		var record stagedUpload
+		if err := doc.DataTo(&record); err != nil {
+			return purged, err
+		}
+		// Backends treat deleting a file that was never uploaded as success
+		if err := s.staging.Delete(ctx, record.Object); err != nil {
+			log.Printf("Failed to purge staged upload %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to purge staged upload %s: %v", doc.Ref.ID, err)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
 
-	return url, nil
+// publicURL is the absolute URL a stored object is served from.
+func (s *StorageService) publicURL(objectPath string) string {
+	return s.publicBaseURL + "/" + objectPath
 }
 
 // getFileExtension returns the file extension based on content type
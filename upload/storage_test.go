@@ -0,0 +1,178 @@
+package upload
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeFirestore keeps documents in memory and answers the queries and writes of the media library:
+// equality filters, limits, sets and updates.
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+	mu   sync.Mutex
+	docs map[string]*pb.Document
+}
+
+func (f *fakeFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	f.mu.Lock()
+	var found []*pb.Document
+	query := req.GetStructuredQuery()
+	prefix := req.Parent + "/" + query.From[0].CollectionId + "/"
+	for name, doc := range f.docs {
+		id := strings.TrimPrefix(name, prefix)
+		if id != name && !strings.Contains(id, "/") && matches(doc, query.Where) {
+			found = append(found, doc)
+		}
+	}
+	f.mu.Unlock()
+
+	if limit := query.GetLimit(); limit != nil && int(limit.Value) < len(found) {
+		found = found[:limit.Value]
+	}
+	for _, doc := range found {
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: timestamppb.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches evaluates the equality filters on string fields, all of which must hold.
+func matches(doc *pb.Document, filter *pb.StructuredQuery_Filter) bool {
+	if filter == nil {
+		return true
+	}
+	if composite := filter.GetCompositeFilter(); composite != nil {
+		for _, f := range composite.Filters {
+			if !matches(doc, f) {
+				return false
+			}
+		}
+		return true
+	}
+	field := filter.GetFieldFilter()
+	value, ok := doc.Fields[field.Field.FieldPath]
+	return ok && field.Op == pb.StructuredQuery_FieldFilter_EQUAL && value.GetStringValue() == field.Value.GetStringValue()
+}
+
+func (f *fakeFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := timestamppb.Now()
+	resp := &pb.CommitResponse{CommitTime: now}
+	for _, write := range req.Writes {
+		doc := write.GetUpdate()
+		if doc == nil {
+			return nil, status.Error(codes.Unimplemented, "only sets and updates are supported")
+		}
+		existing, ok := f.docs[doc.Name]
+		if write.GetCurrentDocument().GetExists() && !ok {
+			return nil, status.Error(codes.NotFound, doc.Name)
+		}
+		if mask := write.GetUpdateMask(); mask != nil && ok {
+			for _, path := range mask.FieldPaths {
+				existing.Fields[path] = doc.Fields[path]
+			}
+		} else {
+			doc.CreateTime, doc.UpdateTime = now, now
+			f.docs[doc.Name] = doc
+		}
+		resp.WriteResults = append(resp.WriteResults, &pb.WriteResult{UpdateTime: now})
+	}
+	return resp, nil
+}
+
+// field returns a field of a stored document.
+func (f *fakeFirestore) field(name, field string) *pb.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.docs["projects/test/databases/(default)/documents/"+name].GetFields()[field]
+}
+
+// count returns how many documents are stored.
+func (f *fakeFirestore) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.docs)
+}
+
+// newFakeFirestore starts a fake Firestore server and returns a client connected to it.
+func newFakeFirestore(t *testing.T) (*firestore.Client, *fakeFirestore) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeFirestore{docs: map[string]*pb.Document{}}
+	server := grpc.NewServer()
+	pb.RegisterFirestoreServer(server, fake)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := firestore.NewClient(context.Background(), "test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, fake
+}
+
+func TestUploadImageDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newFakeFirestore(t)
+	backend, err := NewLocalBackend(t.TempDir(), "http://localhost/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStorageService(backend, nil, "http://localhost/files", client)
+
+	upload := func(data, uploadType string) UploadResult {
+		t.Helper()
+		result, err := s.UploadImage(ctx, []byte(data), nil, "image/gif", uploadType)
+		if err != nil {
+			t.Fatalf("UploadImage() error = %v", err)
+		}
+		return result
+	}
+
+	first := upload("GIF89a first", "advertise")
+	if first.Duplicate {
+		t.Fatal("first upload reported as a duplicate")
+	}
+	uploadedAt := fake.field("media/"+first.ID, "uploaded_at").GetTimestampValue().AsTime()
+
+	again := upload("GIF89a first", "advertise")
+	if !again.Duplicate || again.ID != first.ID || again.URL != first.URL {
+		t.Errorf("same file again = %+v, want the duplicate of %+v", again, first)
+	}
+	bumped := fake.field("media/"+first.ID, "uploaded_at").GetTimestampValue().AsTime()
+	if !bumped.After(uploadedAt) {
+		t.Errorf("uploaded_at = %v, want it bumped after %v", bumped, uploadedAt)
+	}
+
+	if other := upload("GIF89a first", "category"); other.Duplicate || other.ID == first.ID {
+		t.Errorf("same file under another type = %+v, want a new asset", other)
+	}
+	if other := upload("GIF89a second", "advertise"); other.Duplicate || other.ID == first.ID {
+		t.Errorf("another file = %+v, want a new asset", other)
+	}
+	if n := fake.count(); n != 3 {
+		t.Errorf("stored %d assets, want 3", n)
+	}
+}
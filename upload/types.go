@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrUnknownType is returned for an upload type that is not in the registry.
+	ErrUnknownType = errors.New("unknown upload type")
+	// ErrFileTooLarge is returned when the file is bigger than the upload type allows.
+	ErrFileTooLarge = errors.New("file is too large")
+	// ErrImageDimensions is returned when the image size is outside the limits of the upload type.
+	ErrImageDimensions = errors.New("image dimensions are out of range")
+)
+
+// TypeRule describes what may be uploaded under one upload type.
+// A zero dimension limit is not checked.
+type TypeRule struct {
+	Formats   []string
+	MaxSize   int64
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+}
+
+// Types is the registry of upload types. The type name becomes the first segment of
+// the object path, so only these names may ever reach the storage service.
+var Types = map[string]TypeRule{
+	"product": {
+		Formats:  []string{"image/jpeg", "image/png", "image/webp"},
+		MaxSize:  10 << 20,
+		MinWidth: 400, MinHeight: 400,
+		MaxWidth: 8000, MaxHeight: 8000,
+	},
+	"category": {
+		Formats:  []string{"image/jpeg", "image/png", "image/webp", "image/svg+xml"},
+		MaxSize:  5 << 20,
+		MinWidth: 200, MinHeight: 200,
+		MaxWidth: 4000, MaxHeight: 4000,
+	},
+	"advertise": {
+		Formats:  []string{"image/jpeg", "image/png", "image/webp", "image/gif"},
+		MaxSize:  10 << 20,
+		MinWidth: 600, MinHeight: 200,
+		MaxWidth: 8000, MaxHeight: 8000,
+	},
+	"avatar": {
+		Formats:  []string{"image/jpeg", "image/png", "image/webp"},
+		MaxSize:  2 << 20,
+		MinWidth: 64, MinHeight: 64,
+		MaxWidth: 4000, MaxHeight: 4000,
+	},
+}
+
+// maxUploadSize returns the largest MaxSize in the registry, used to cap the request body.
+func maxUploadSize(types map[string]TypeRule) int64 {
+	var size int64
+	for _, rule := range types {
+		size = max(size, rule.MaxSize)
+	}
+	return size
+}
+
+// allowsFormat reports whether contentType may be uploaded under this type.
+func (t TypeRule) allowsFormat(contentType string) bool {
+	return slices.Contains(t.Formats, contentType)
+}
+
+// checkSize rejects files larger than MaxSize.
+func (t TypeRule) checkSize(size int64) error {
+	if t.MaxSize > 0 && size > t.MaxSize {
+		return fmt.Errorf("%w: at most %d MB allowed", ErrFileTooLarge, t.MaxSize>>20)
+	}
+	return nil
+}
+
+// checkDimensions rejects images outside the width and height limits.
+func (t TypeRule) checkDimensions(width, height int) error {
+	if (t.MinWidth > 0 && width < t.MinWidth) || (t.MinHeight > 0 && height < t.MinHeight) ||
+		(t.MaxWidth > 0 && width > t.MaxWidth) || (t.MaxHeight > 0 && height > t.MaxHeight) {
+		return fmt.Errorf("%w: got %dx%d, allowed %dx%d to %dx%d",
+			ErrImageDimensions, width, height, t.MinWidth, t.MinHeight, t.MaxWidth, t.MaxHeight)
+	}
+	return nil
+}
+
+// formatNames lists the allowed formats for error messages, e.g. "jpeg, png".
+func (t TypeRule) formatNames() string {
+	names := make([]string, len(t.Formats))
+	for i, format := range t.Formats {
+		names[i] = strings.TrimSuffix(strings.TrimPrefix(format, "image/"), "+xml")
+	}
+	return strings.Join(names, ", ")
+}
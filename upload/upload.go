@@ -1,15 +1,49 @@
 package upload
 
-import "context"
+import (
+	"context"
+	"image"
+	"time"
+)
 
 // UploadResult represents the result of an upload operation.
+// URL points at the large JPEG for raster images and at the stored file otherwise.
 type UploadResult struct {
-	ID   string `json:"id"`
-	URL  string `json:"url"`
-	Type string `json:"type"`
+	ID       string             `json:"id"`
+	URL      string             `json:"url"`
+	Type     string             `json:"type"`
+	Width    int                `json:"width,omitempty"`
+	Height   int                `json:"height,omitempty"`
+	Blurhash string             `json:"blurhash,omitempty"`
+	Variants map[string]Variant `json:"variants,omitempty"`
+	// Duplicate is set when the same file had already been uploaded and its asset is returned instead.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// Variant holds the URLs of one resized copy of an uploaded image.
+// WebP is empty when the WebP file would not have been smaller than the JPEG.
+type Variant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	WebP   string `json:"webp,omitempty"`
+	JPEG   string `json:"jpeg"`
 }
 
 // Service provides upload operations.
 type Service interface {
-	UploadImage(ctx context.Context, fileData []byte, contentType string, uploadType string) (UploadResult, error)
+	// UploadImage stores a validated upload. decoded is the image validateImage already decoded,
+	// or nil for formats that are stored as received.
+	UploadImage(ctx context.Context, fileData []byte, decoded image.Image, contentType string, uploadType string) (UploadResult, error)
+
+	// Direct uploads: the client PUTs the file to a signed URL and then asks for it to be finalized
+	SignUpload(ctx context.Context, uploadType, contentType string, size int64) (SignedUpload, error)
+	ReadStagedUpload(ctx context.Context, uploadType, id string, maxSize int64) ([]byte, string, error)
+	DeleteStagedUpload(ctx context.Context, uploadType, id string) error
+	PurgeExpiredUploads(ctx context.Context, before time.Time) (int, error)
+
+	// Media library
+	AdminGetAssets(ctx context.Context, page, pageSize int, uploadType string) ([]Asset, int, error)
+	AdminGetAsset(ctx context.Context, id string) (Asset, error)
+	AdminDeleteAsset(ctx context.Context, id string) error
+	PurgeOrphanAssets(ctx context.Context, before time.Time, dryRun bool) (int, error)
 }